@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+)
+
+// the number of recent errors kept
+const maxRecentErrors = 20
+
+// daemonStatus is reported by the admin api.
+type daemonStatus struct {
+	Pid       int              `json:"pid"`
+	Start     time.Time        `json:"start"`
+	Pipelines []pipelineStatus `json:"pipelines"`
+}
+
+// pipelineStatus is the status of a pipeline.
+type pipelineStatus struct {
+	Name    string `json:"name"`
+	Samba   string `json:"samba"`
+	Phase   State  `json:"phase"`
+	Paused  bool   `json:"paused"`
+	Cont    string `json:"container"` // last selected container
+	Batch   int    `json:"batch"`     // id of the batch being handled
+	Pending int    `json:"pending"`   // files waiting in monitor
+	Queued  int    `json:"queued"`    // batches waiting for handler
+	Open    int    `json:"open"`      // batches not done
+	Dead    int    `json:"dead"`      // files in dead letter queue
+}
+
+// recentError is an error logged recently.
+type recentError struct {
+	Time   time.Time              `json:"time"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+var status = struct {
+	mu     gosync.Mutex
+	start  time.Time
+	errors []recentError
+}{start: time.Now()}
+
+// recordError keeps the error for the admin api, kv is a list of
+// alternate keys and values, with secrets redacted.
+func recordError(msg string, kv []interface{}) {
+	e := recentError{Time: time.Now(), Msg: msg}
+	if len(kv) > 0 {
+		e.Fields = make(map[string]interface{})
+		for i := 0; i < len(kv); i += 2 {
+			e.Fields[fieldKey(kv, i)] = jsonValue(fieldValue(kv, i))
+		}
+	}
+
+	status.mu.Lock()
+	defer status.mu.Unlock()
+
+	status.errors = append(status.errors, e)
+	if len(status.errors) > maxRecentErrors {
+		status.errors = status.errors[len(status.errors)-maxRecentErrors:]
+	}
+}
+
+func (p *pipeline) status() pipelineStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return pipelineStatus{
+		Name:    p.name,
+		Samba:   p.getConf().Samba,
+		Phase:   p.show.State(),
+		Paused:  p.isPaused(),
+		Cont:    p.cont,
+		Batch:   p.batch,
+		Pending: p.pending,
+		Queued:  p.queue.Len(),
+		Open:    len(p.jnl.Open()),
+		Dead:    p.deadq.Len(),
+	}
+}
+
+func getStatus(ps []*pipeline) daemonStatus {
+	s := daemonStatus{Pid: os.Getpid(), Start: status.start}
+	for _, p := range ps {
+		s.Pipelines = append(s.Pipelines, p.status())
+	}
+	return s
+}
+
+// getErrors returns the recent errors of pipeline, or all if empty.
+func getErrors(pipeline string) []recentError {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+
+	errs := []recentError{}
+	for _, e := range status.errors {
+		// the default pipeline logs without a pipeline field
+		name, ok := e.Fields["pipeline"]
+		if !ok {
+			name = DefaultPipeline
+		}
+		if pipeline == "" || name == pipeline {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// selectPipelines returns the pipeline named in request, or all if not
+// given. It replies not found if there is no such pipeline.
+func selectPipelines(w http.ResponseWriter, r *http.Request) ([]*pipeline, bool) {
+	name := r.FormValue("pipeline")
+	if name == "" {
+		return pipelines, true
+	}
+	if p := findPipeline(name); p != nil {
+		return []*pipeline{p}, true
+	}
+	http.Error(w, "unknown pipeline: "+name, http.StatusNotFound)
+	return nil, false
+}
+
+// withPipelines wraps a handler of the pipelines selected by request.
+func withPipelines(f func(w http.ResponseWriter, r *http.Request, ps []*pipeline)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ps, ok := selectPipelines(w, r)
+		if ok {
+			f(w, r, ps)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
+// post wraps a handler which changes state, accepting POST only.
+func post(f func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// serveAPI serves the admin api on addr. Every request applies to the
+// pipeline given by parameter pipeline=NAME, or all if not given:
+//
+//	GET  /status                 phase, container and queue sizes
+//	GET  /queue                  requests not done
+//	GET  /errors                 recent errors
+//	POST /pause                  stop emitting batches, events are still recorded
+//	POST /resume                 resume emitting batches
+//	POST /flush                  emit pending files without waiting gap
+//	POST /sync?container=NAME    sync the container
+func serveAPI(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", withPipelines(func(w http.ResponseWriter, r *http.Request, ps []*pipeline) {
+		writeJSON(w, http.StatusOK, getStatus(ps))
+	}))
+
+	mux.HandleFunc("/queue", withPipelines(func(w http.ResponseWriter, r *http.Request, ps []*pipeline) {
+		queues := make(map[string][]Request)
+		for _, p := range ps {
+			reqs := p.jnl.Open()
+			if reqs == nil {
+				reqs = []Request{}
+			}
+			queues[p.name] = reqs
+		}
+		writeJSON(w, http.StatusOK, queues)
+	}))
+
+	mux.HandleFunc("/errors", withPipelines(func(w http.ResponseWriter, r *http.Request, ps []*pipeline) {
+		writeJSON(w, http.StatusOK, getErrors(r.FormValue("pipeline")))
+	}))
+
+	mux.HandleFunc("/pause", post(withPipelines(func(w http.ResponseWriter, r *http.Request, ps []*pipeline) {
+		for _, p := range ps {
+			atomic.StoreInt32(&p.paused, 1)
+			p.log.Info("pause watcher")
+		}
+		writeJSON(w, http.StatusOK, getStatus(ps))
+	})))
+
+	mux.HandleFunc("/resume", post(withPipelines(func(w http.ResponseWriter, r *http.Request, ps []*pipeline) {
+		for _, p := range ps {
+			atomic.StoreInt32(&p.paused, 0)
+			p.log.Info("resume watcher")
+		}
+		writeJSON(w, http.StatusOK, getStatus(ps))
+	})))
+
+	mux.HandleFunc("/flush", post(withPipelines(func(w http.ResponseWriter, r *http.Request, ps []*pipeline) {
+		for _, p := range ps {
+			select {
+			case p.chFlush <- true:
+			default:
+				// a flush is not handled yet
+			}
+			p.log.Info("flush pending files")
+		}
+		writeJSON(w, http.StatusAccepted, getStatus(ps))
+	})))
+
+	mux.HandleFunc("/sync", post(withPipelines(func(w http.ResponseWriter, r *http.Request, ps []*pipeline) {
+		cont := r.FormValue("container")
+
+		// the pipeline of container
+		var owners []*pipeline
+		for _, p := range ps {
+			for _, c := range p.getConf().Conts {
+				if c == cont {
+					owners = append(owners, p)
+					break
+				}
+			}
+		}
+		if len(owners) == 0 {
+			http.Error(w, "unknown container: "+cont, http.StatusBadRequest)
+			return
+		}
+		if len(owners) > 1 {
+			http.Error(w, "container of several pipelines, give pipeline: "+cont, http.StatusBadRequest)
+			return
+		}
+
+		p := owners[0]
+		select {
+		case p.chSyncReq <- cont:
+			p.log.Info("request sync", "container", cont)
+			writeJSON(w, http.StatusAccepted, getStatus(owners))
+		default:
+			http.Error(w, "too many sync requests", http.StatusServiceUnavailable)
+		}
+	})))
+
+	logger.Info("admin api listen", "addr", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		logger.Error("admin api error", "addr", addr, "error", err)
+	}
+}
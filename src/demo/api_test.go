@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestErrorsOfPipeline(t *testing.T) {
+	status.mu.Lock()
+	status.errors = nil
+	status.mu.Unlock()
+
+	recordError("fail to upload file", []interface{}{"file", "a.mp4"})
+	recordError("fail to upload file", []interface{}{"pipeline", "studio-b", "file", "b.mp4"})
+
+	for _, c := range []struct {
+		pipeline string
+		file     string
+	}{
+		{DefaultPipeline, "a.mp4"},
+		{"studio-b", "b.mp4"},
+	} {
+		errs := getErrors(c.pipeline)
+		if len(errs) != 1 || errs[0].Fields["file"] != c.file {
+			t.Errorf("errors of %s = %+v, want the one of %s", c.pipeline, errs, c.file)
+		}
+	}
+	if errs := getErrors(""); len(errs) != 2 {
+		t.Errorf("errors = %+v, want 2", errs)
+	}
+}
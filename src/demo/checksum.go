@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// checksum algorithm
+const (
+	ChecksumNone   string = ""
+	ChecksumMD5    string = "md5"
+	ChecksumSHA256 string = "sha256"
+)
+
+// the object metadata key of checksum, valued as "<algorithm>:<hex>"
+const MetaChecksum string = "checksum"
+
+var errNotSupported = errors.New("not supported")
+
+// ObjectInfo is the remote state of an object.
+type ObjectInfo struct {
+	Size int64
+	Meta map[string]string
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("unknown checksum: %s", algo)
+}
+
+// checksum returns "<algorithm>:<hex>" of the content of file.
+func checksum(file, algo string) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return algo + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verify checks that the object in cont matches the local file.
+func (p *pipeline) verify(cont, object, file, sum string) error {
+	info, err := p.getUploader().Stat(cont, object)
+	if err == errNotSupported {
+		p.log.Debug("skip verifying object", "file", object, "container", cont)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	local, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	if info.Size != local.Size() {
+		return fmt.Errorf("size mismatch: %s, local %d, remote %d",
+			object, local.Size(), info.Size)
+	}
+
+	if sum != "" && info.Meta[MetaChecksum] != sum {
+		return fmt.Errorf("checksum mismatch: %s, local %s, remote %s",
+			object, sum, info.Meta[MetaChecksum])
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage: demo <command> [options]
+
+commands:
+    run        watch samba directories and upload files (default)
+    genconf    print an example configuration
+    validate   check the configuration and exit
+    status     query the status of a running instance
+    receive    receive signals and webhook events, for testing controllers
+    config     show the configuration: config show [-effective]
+
+run "demo <command> -h" for the options of a command.
+`
+
+// overrides of configuration given on command line,
+// applied every time the configuration file is loaded
+var overrides = func(conf *Config, src confSource) {}
+
+// confFlags registers the flags which override configuration fields,
+// the returned function applies the flags set on command line.
+func confFlags(fs *flag.FlagSet) func(*Config, confSource) {
+	var c Config
+	var conts string
+
+	fs.StringVar(&c.Samba, "samba", "", "samba directory to watch")
+	fs.StringVar(&c.Udp, "udp", "", "udp address of show controller")
+	fs.StringVar(&c.Tcp, "tcp", "", "tcp address of show controller")
+	fs.StringVar(&conts, "container", "", "comma separated containers")
+	fs.StringVar(&c.Dam, "dam", "", "address of dam")
+	fs.StringVar(&c.Tenant, "tenant", "", "tenant of dam")
+	fs.StringVar(&c.User, "user", "", "user of dam")
+	fs.StringVar(&c.Protocol, "protocol", "", "signal protocol: raw or reliable")
+	fs.StringVar(&c.Select, "select", "", "strategy of container selection")
+	fs.StringVar(&c.Watcher, "watcher", "", "watcher of samba directory: fsnotify or poll")
+	fs.StringVar(&c.Backend, "backend", "", "uploader backend: dacli or dam")
+	fs.StringVar(&c.Checksum, "checksum", "", "checksum algorithm: md5 or sha256, with backend dam")
+	fs.StringVar(&c.StateDir, "state", "", "state directory")
+	fs.StringVar(&c.Admin, "admin", "", "listen address of admin api")
+	fs.StringVar(&c.Metrics, "metrics", "", "listen address of metrics")
+	fs.IntVar(&c.Cool, "cool", 0, "seconds to wait before upload")
+	fs.IntVar(&c.Gap, "gap", 0, "seconds without change to end a batch")
+	fs.IntVar(&c.Retry, "retry", 0, "retries of each file")
+	fs.IntVar(&c.Backoff, "backoff", 0, "seconds before the first retry")
+	fs.IntVar(&c.Workers, "workers", 0, "files uploaded in parallel")
+	fs.IntVar(&c.Shutdown, "shutdown", 0, "seconds to wait for the current batch on exit")
+	fs.IntVar(&c.AckTimeout, "ack-timeout", 0, "milliseconds to wait for an ack of signal")
+	fs.IntVar(&c.Retransmit, "retransmit", 0, "retransmissions of an unacknowledged signal")
+
+	return func(conf *Config, src confSource) {
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "samba":
+				conf.Samba = c.Samba
+			case "udp":
+				conf.Udp = c.Udp
+			case "tcp":
+				conf.Tcp = c.Tcp
+			case "container":
+				conf.Conts = strings.Split(conts, ",")
+			case "dam":
+				conf.Dam = c.Dam
+			case "tenant":
+				conf.Tenant = c.Tenant
+			case "user":
+				conf.User = c.User
+			case "protocol":
+				conf.Protocol = c.Protocol
+			case "select":
+				conf.Select = c.Select
+			case "watcher":
+				conf.Watcher = c.Watcher
+			case "backend":
+				conf.Backend = c.Backend
+			case "checksum":
+				conf.Checksum = c.Checksum
+			case "state":
+				conf.StateDir = c.StateDir
+			case "admin":
+				conf.Admin = c.Admin
+			case "metrics":
+				conf.Metrics = c.Metrics
+			case "cool":
+				conf.Cool = c.Cool
+			case "gap":
+				conf.Gap = c.Gap
+			case "retry":
+				conf.Retry = c.Retry
+			case "backoff":
+				conf.Backoff = c.Backoff
+			case "workers":
+				conf.Workers = c.Workers
+			case "shutdown":
+				conf.Shutdown = c.Shutdown
+			case "ack-timeout":
+				conf.AckTimeout = c.AckTimeout
+			case "retransmit":
+				conf.Retransmit = c.Retransmit
+			default:
+				return
+			}
+			// flags are named after fields, e.g. -ack-timeout for ack_timeout
+			src[strings.Replace(f.Name, "-", "_", -1)] = "flag -" + f.Name
+		})
+	}
+}
+
+// parseConfFlags parses the flags of a command which loads configuration,
+// extra registers the other flags of the command.
+func parseConfFlags(name string, args []string, extra ...func(fs *flag.FlagSet)) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&confPath, "config", "", "configuration file, default $"+ConfEnv+" or searched in "+strings.Join(confDirs(), ", "))
+	apply := confFlags(fs)
+	for _, f := range extra {
+		f(fs)
+	}
+	fs.Parse(args)
+
+	if confPath != "" {
+		path, err := filepath.Abs(confPath)
+		if err == nil {
+			confPath = path
+		}
+	}
+	overrides = apply
+	return fs
+}
+
+func runCmd(args []string) {
+	parseConfFlags("run", args)
+	setup()
+	run()
+}
+
+func genconfCmd(args []string) {
+	fs := flag.NewFlagSet("genconf", flag.ExitOnError)
+	out := fs.String("o", "", "write to file instead of stdout")
+	fs.Parse(args)
+
+	err := genConf(*out)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func validateCmd(args []string) {
+	parseConfFlags("validate", args)
+
+	conf, err := loadConf()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	err = validateConf(conf)
+	if errs, ok := err.(ConfErrors); ok {
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Println("configuration ok:", confPath)
+}
+
+func configCmd(args []string) {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Fprintln(os.Stderr, "usage: demo config show [-effective] [options]")
+		os.Exit(2)
+	}
+
+	var effective bool
+	parseConfFlags("config show", args[1:], func(fs *flag.FlagSet) {
+		fs.BoolVar(&effective, "effective", false, "show the source of each field")
+	})
+
+	conf, src, err := loadConfSource()
+	if err != nil {
+		os.Exit(1)
+	}
+	if !effective {
+		src = nil
+	}
+
+	err = showConf(conf, src)
+	if err != nil {
+		logger.Fatal("fail to show config", "error", err)
+	}
+}
+
+func statusCmd(args []string) {
+	var name string
+	fs := parseConfFlags("status", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&name, "pipeline", "", "status of the pipeline only")
+	})
+	addr := fs.Lookup("admin").Value.String()
+
+	if addr == "" {
+		conf, err := loadConf()
+		if err != nil {
+			os.Exit(1)
+		}
+		addr = conf.Admin
+	}
+	if addr == "" {
+		logger.Fatal("no admin address in configuration")
+	}
+
+	u := "http://" + addr + "/status"
+	if name != "" {
+		u += "?pipeline=" + url.QueryEscape(name)
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		logger.Fatal("fail to query status", "addr", addr, "error", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Fatal("fail to query status", "addr", addr, "error", err)
+	}
+	os.Stdout.Write(b)
+
+	if resp.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
+
+func receiveCmd(args []string) {
+	fs := flag.NewFlagSet("receive", flag.ExitOnError)
+	udp := fs.String("udp", "localhost:1234", "udp address to listen, in reliable protocol")
+	hook := fs.String("http", "", "http address to listen as a webhook")
+	secret := fs.String("secret", "", "secret to check signature of webhook")
+	fs.Parse(args)
+
+	if *hook != "" {
+		go func() {
+			logger.Info("receive webhook", "addr", *hook)
+			err := http.ListenAndServe(*hook, webhookHandler(*secret, func(ev signalEvent) {
+				b, _ := json.Marshal(ev)
+				fmt.Println(string(b))
+			}))
+			logger.Fatal("fail to receive webhook", "addr", *hook, "error", err)
+		}()
+	}
+
+	logger.Info("receive signals", "addr", *udp)
+	err := receiveSignals(*udp, func(code string) {
+		fmt.Println(code, msgInfo[code])
+	})
+	if err != nil {
+		logger.Fatal("fail to receive signals", "addr", *udp, "error", err)
+	}
+}
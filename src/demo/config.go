@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration is layered, a later layer overrides an earlier one:
+// defaults, configuration file, environment DEMO_* and command line.
+
+// the environment of configuration file, searched if not set
+const ConfEnv string = "DEMO_CONFIG"
+
+// the prefix of environment overriding configuration fields,
+// e.g. DEMO_SAMBA, DEMO_LOG_LEVEL
+const confEnvPrefix = "DEMO_"
+
+// names of configuration file searched in each directory
+var confNames = []string{"demo.conf", "demo.json", "demo.yaml", "demo.yml", "demo.toml"}
+
+// confSource is where each configuration field comes from, e.g.
+// "default", "file /etc/demo/demo.conf", "env DEMO_SAMBA" or
+// "flag -samba". The key is the path of json names, e.g. "log.level".
+type confSource map[string]string
+
+// confDirs returns the directories searched for configuration file,
+// in order: $XDG_CONFIG_HOME/demo, $XDG_CONFIG_DIRS/demo and /etc/demo.
+func confDirs() []string {
+	var dirs []string
+
+	home := os.Getenv("XDG_CONFIG_HOME")
+	if home == "" {
+		if h, err := os.UserHomeDir(); err == nil {
+			home = filepath.Join(h, ".config")
+		}
+	}
+	if home != "" {
+		dirs = append(dirs, filepath.Join(home, "demo"))
+	}
+
+	xdg := os.Getenv("XDG_CONFIG_DIRS")
+	if xdg == "" {
+		xdg = "/etc/xdg"
+	}
+	for _, dir := range filepath.SplitList(xdg) {
+		if dir != "" {
+			dirs = append(dirs, filepath.Join(dir, "demo"))
+		}
+	}
+
+	return append(dirs, filepath.Dir(ConfPath))
+}
+
+// findConf returns the configuration file: the one given by -config,
+// or $DEMO_CONFIG, or the first found in confDirs. It returns empty
+// if none is found, the given one must exist.
+func findConf() (string, error) {
+	file := confPath
+	if file == "" {
+		file = os.Getenv(ConfEnv)
+	}
+	if file != "" {
+		if _, err := os.Stat(file); err != nil {
+			return "", err
+		}
+		return filepath.Abs(file)
+	}
+
+	for _, dir := range confDirs() {
+		for _, name := range confNames {
+			file := filepath.Join(dir, name)
+			if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+				return file, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseConfFile parses a configuration file by its extension: yaml,
+// toml, or json otherwise.
+func parseConfFile(file string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree map[string]interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &tree)
+		if tree == nil {
+			tree = map[string]interface{}{}
+		}
+		return tree, err
+	case ".toml":
+		_, err = toml.Decode(string(b), &tree)
+		return tree, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = dec.Decode(&tree)
+	return tree, err
+}
+
+// jsonName returns the json name of a struct field, empty if ignored.
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" || f.PkgPath != "" {
+		return ""
+	}
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func fieldByName(t reflect.Type, name string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if jsonName(t.Field(i)) == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// isTable reports whether a field is a table of fields, rather than
+// a value set as a whole.
+func isTable(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct
+}
+
+// confFields calls f with the path and value of every field of v.
+func confFields(v reflect.Value, prefix string, f func(path string, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		if isTable(t.Field(i).Type) {
+			confFields(v.Field(i), prefix+name+".", f)
+			continue
+		}
+		f(prefix+name, v.Field(i))
+	}
+}
+
+// layerTree sets the fields of v in tree parsed from source, and
+// records the source of them.
+func layerTree(v reflect.Value, tree map[string]interface{}, prefix, source string, src confSource) error {
+	t := v.Type()
+	for name, x := range tree {
+		path := prefix + name
+		i, ok := fieldByName(t, name)
+		if !ok {
+			logger.Warn("unknown config field", "field", path, "source", source)
+			continue
+		}
+
+		f := v.Field(i)
+		if isTable(f.Type()) {
+			m, ok := x.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: want a table, got %v", path, x)
+			}
+			err := layerTree(f, m, path+".", source, src)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := assign(f, x)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		src[path] = source
+	}
+	return nil
+}
+
+// layerEnv sets the fields of v overridden in environment.
+func layerEnv(v reflect.Value, src confSource) error {
+	var err error
+	confFields(v, "", func(path string, f reflect.Value) {
+		env := confEnv(path)
+		s, ok := os.LookupEnv(env)
+		if !ok || err != nil {
+			return
+		}
+
+		var x interface{}
+		x, err = envValue(f.Type(), s)
+		if err == nil {
+			err = assign(f, x)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %v", env, err)
+			return
+		}
+		src[path] = "env " + env
+	})
+	return err
+}
+
+// confEnv returns the environment overriding the field of path.
+func confEnv(path string) string {
+	return confEnvPrefix + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// envValue parses the value of environment for a field of type t.
+// A list is comma separated and a map is comma separated key=value,
+// or either in json; other composite values are in json.
+func envValue(t reflect.Type, s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		var x interface{}
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.UseNumber()
+		err := dec.Decode(&x)
+		return x, err
+	}
+
+	switch {
+	case t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Struct:
+		var xs []interface{}
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				xs = append(xs, e)
+			}
+		}
+		return xs, nil
+	case t.Kind() == reflect.Map:
+		m := make(map[string]interface{})
+		for _, e := range strings.Split(s, ",") {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("want key=value, got %q", e)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		return m, nil
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Struct:
+		return nil, fmt.Errorf("want json, got %q", s)
+	}
+	return s, nil
+}
+
+// assign sets v to x, a value parsed from json, yaml, toml or
+// environment. Scalars are converted to the type of v, e.g. "10"
+// to int, as environment gives strings.
+func assign(v reflect.Value, x interface{}) error {
+	if x == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		switch x := x.(type) {
+		case string:
+			v.SetString(x)
+		case json.Number:
+			v.SetString(x.String())
+		case int, int64, float64, bool:
+			v.SetString(fmt.Sprint(x))
+		default:
+			return fmt.Errorf("want a string, got %v", x)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		var err error
+		switch x := x.(type) {
+		case int:
+			n = int64(x)
+		case int64:
+			n = x
+		case float64:
+			n = int64(x)
+			if float64(n) != x {
+				err = fmt.Errorf("want an integer, got %v", x)
+			}
+		case json.Number:
+			n, err = strconv.ParseInt(x.String(), 10, 64)
+		case string:
+			n, err = strconv.ParseInt(strings.Replace(x, "_", "", -1), 0, 64)
+		default:
+			err = fmt.Errorf("want an integer, got %v", x)
+		}
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("%d overflows %v", n, v.Type())
+		}
+		v.SetInt(n)
+
+	case reflect.Bool:
+		switch x := x.(type) {
+		case bool:
+			v.SetBool(x)
+		case string:
+			b, err := strconv.ParseBool(x)
+			if err != nil {
+				return err
+			}
+			v.SetBool(b)
+		default:
+			return fmt.Errorf("want a boolean, got %v", x)
+		}
+
+	case reflect.Slice:
+		// toml gives arrays of tables as []map[string]interface{}
+		xs := reflect.ValueOf(x)
+		if xs.Kind() != reflect.Slice {
+			return fmt.Errorf("want a list, got %v", x)
+		}
+		s := reflect.MakeSlice(v.Type(), xs.Len(), xs.Len())
+		for i := 0; i < xs.Len(); i++ {
+			if err := assign(s.Index(i), xs.Index(i).Interface()); err != nil {
+				return fmt.Errorf("[%d]: %v", i, err)
+			}
+		}
+		v.Set(s)
+
+	case reflect.Map:
+		m, ok := x.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("want a table, got %v", x)
+		}
+		mv := reflect.MakeMapWithSize(v.Type(), len(m))
+		for k, e := range m {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := assign(ev, e); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+			mv.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), ev)
+		}
+		v.Set(mv)
+
+	case reflect.Struct:
+		m, ok := x.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("want a table, got %v", x)
+		}
+		for k, e := range m {
+			i, ok := fieldByName(v.Type(), k)
+			if !ok {
+				return fmt.Errorf("unknown field %s", k)
+			}
+			if err := assign(v.Field(i), e); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+		}
+
+	case reflect.Interface:
+		// kept as parsed, e.g. a pipeline layered later
+		v.Set(reflect.ValueOf(x))
+
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// loadLayers loads the configuration from all layers.
+func loadLayers() (Config, confSource, error) {
+	conf := defaultConf()
+	src := make(confSource)
+	v := reflect.ValueOf(&conf).Elem()
+	confFields(v, "", func(path string, f reflect.Value) {
+		src[path] = "default"
+	})
+
+	file, err := findConf()
+	if err != nil {
+		logger.Error("fail to find config", "error", err)
+		return Config{}, nil, err
+	}
+
+	if file == "" {
+		logger.Warn("no config file found, use defaults and environment", "dirs", confDirs())
+	} else {
+		logger.Info("config file", "file", file)
+		// keep the file found, which is watched and reloaded
+		confPath = file
+
+		tree, err := parseConfFile(file)
+		if err != nil {
+			logger.Error("fail to parse config", "file", file, "error", err)
+			return Config{}, nil, err
+		}
+		err = layerTree(v, tree, "", "file "+file, src)
+		if err != nil {
+			logger.Error("fail to parse config", "file", file, "error", err)
+			return Config{}, nil, err
+		}
+	}
+
+	err = layerEnv(v, src)
+	if err != nil {
+		logger.Error("fail to parse config environment", "error", err)
+		return Config{}, nil, err
+	}
+
+	overrides(&conf, src)
+	return conf, src, nil
+}
+
+// cleanPaths cleans the directories of conf, e.g. a trailing slash
+// of samba, as fsnotify reports cleaned paths which must match them.
+func cleanPaths(conf *Config) {
+	if conf.Samba != "" {
+		conf.Samba = filepath.Clean(conf.Samba)
+	}
+	if conf.StateDir != "" {
+		conf.StateDir = filepath.Clean(conf.StateDir)
+	}
+}
+
+// passSource returns where the password comes from.
+func passSource(conf Config, src confSource) string {
+	switch {
+	case conf.PassEnv != "":
+		return "env " + conf.PassEnv
+	case conf.PassFile != "":
+		return "file " + conf.PassFile
+	case len(conf.PassCmd) > 0:
+		return "command " + conf.PassCmd[0]
+	}
+	return src["pass"]
+}
+
+// showConf prints the configuration with secrets redacted, and the
+// source of each field if src is given.
+func showConf(conf Config, src confSource) error {
+	conf = logger.Redacted(conf).(Config)
+	if src == nil {
+		b, err := json.MarshalIndent(conf, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	type field struct{ path, value string }
+	var fields []field
+	confFields(reflect.ValueOf(conf), "", func(path string, v reflect.Value) {
+		b, _ := json.Marshal(v.Interface())
+		fields = append(fields, field{path, string(b)})
+	})
+
+	width := 0
+	for _, f := range fields {
+		if len(f.path) > width {
+			width = len(f.path)
+		}
+	}
+	for _, f := range fields {
+		fmt.Printf("%-*s = %s  # %s\n", width, f.path, f.value, src[f.path])
+	}
+	return nil
+}
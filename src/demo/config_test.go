@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var confFiles = map[string]string{
+	"demo.yaml": `# comment
+container: [hello, test]
+pass: 'it''s # x'
+gap: 2
+targets:
+  - name: hook
+    proto: http
+    headers: {Authorization: Bearer x}
+pipelines:
+  - name: studio-b
+    gap: 5
+`,
+	"demo.toml": `container = ["hello", "test"]
+pass = "it's # x"
+gap = 2
+
+[[targets]]
+name = "hook"
+proto = "http"
+headers = { Authorization = "Bearer x" }
+
+[[pipelines]]
+name = "studio-b"
+gap = 5
+`,
+	"demo.conf": `{
+	"container": ["hello", "test"],
+	"pass": "it's # x",
+	"gap": 2,
+	"targets": [{"name": "hook", "proto": "http", "headers": {"Authorization": "Bearer x"}}],
+	"pipelines": [{"name": "studio-b", "gap": 5}]
+}`,
+}
+
+func TestParseConfFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range confFiles {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err := parseConfFile(file)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		var conf Config
+		if err := layerTree(reflect.ValueOf(&conf).Elem(), tree, "", name, confSource{}); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if conf.Pass != "it's # x" || conf.Gap != 2 || !reflect.DeepEqual(conf.Conts, []string{"hello", "test"}) {
+			t.Errorf("%s: pass %q, gap %d, containers %v", name, conf.Pass, conf.Gap, conf.Conts)
+		}
+		if len(conf.Targets) != 1 || conf.Targets[0].Headers["Authorization"] != "Bearer x" {
+			t.Errorf("%s: targets %+v", name, conf.Targets)
+		}
+		if len(conf.Pipelines) != 1 || conf.Pipelines[0]["name"] != "studio-b" {
+			t.Errorf("%s: pipelines %v", name, conf.Pipelines)
+		}
+	}
+}
+
+// fsnotify cleans the paths it watches, so must samba be.
+func TestLoadConfCleanSamba(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "demo.conf")
+	content := `{"samba": "` + dir + `/a/", "pipelines": [{"name": "b", "samba": "` + dir + `/b/"}]}`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ConfEnv, file)
+	saved := confPath
+	confPath = ""
+	t.Cleanup(func() { confPath = saved })
+
+	conf, err := loadConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Samba != filepath.Join(dir, "a") {
+		t.Errorf("samba = %q, want %q", conf.Samba, filepath.Join(dir, "a"))
+	}
+	confs, err := pipelineConfs(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confs[0].Samba != filepath.Join(dir, "b") {
+		t.Errorf("samba of pipeline = %q, want %q", confs[0].Samba, filepath.Join(dir, "b"))
+	}
+}
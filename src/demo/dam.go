@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backend of uploader, dacli is the default until the native client
+// is checked against a real DAM
+const (
+	BackendDam   string = "dam"
+	BackendDacli string = "dacli"
+)
+
+// timeouts of the native client
+const (
+	damTimeout = 5 * time.Minute // a request besides the body of object
+	damMinRate = 1 << 20         // bytes per second, slower uploads time out
+)
+
+// Uploader puts objects to the DAM object store and syncs containers.
+type Uploader interface {
+	PutObject(cont, object, file string, meta map[string]string) error
+	Stat(cont, object string) (ObjectInfo, error)
+	Sync(cont string) error
+}
+
+func newUploader(conf Config) (Uploader, error) {
+	switch conf.Backend {
+	case BackendDam:
+		return newDamClient(conf), nil
+	case "", BackendDacli:
+		if conf.DacliPass == DacliPassArgv {
+			logger.Warn("password of dacli is visible in process list", "dacli_pass", conf.DacliPass)
+		}
+		return &dacliUploader{conf: conf}, nil
+	}
+	return nil, fmt.Errorf("unknown backend: %s", conf.Backend)
+}
+
+// DamError is returned when the DAM endpoint rejects a request.
+type DamError struct {
+	Op     string
+	Cont   string
+	Object string
+	Status int
+	Msg    string
+}
+
+func (e *DamError) Error() string {
+	if e.Object != "" {
+		return fmt.Sprintf("dam %s %s/%s: %d %s", e.Op, e.Cont, e.Object, e.Status, e.Msg)
+	}
+	return fmt.Sprintf("dam %s %s: %d %s", e.Op, e.Cont, e.Status, e.Msg)
+}
+
+// damClient talks to the DAM endpoint over http:
+//
+//	PUT  <dam>/v1/<tenant>/<container>/<object>   put object
+//	POST <dam>/v1/<tenant>/<container>?sync       sync container
+//
+// object metadata is sent as X-Object-Meta-<key> headers. The layout is
+// not checked against a real DAM yet, so the backend is not the default.
+//
+// Every request has a deadline, a put gets more time for a larger
+// object, so a stalled connection fails the upload to be retried.
+type damClient struct {
+	base   string
+	tenant string
+	user   string
+	pass   string
+	client *http.Client
+}
+
+func newDamClient(conf Config) *damClient {
+	base := conf.Dam
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+
+	return &damClient{
+		base:   strings.TrimRight(base, "/"),
+		tenant: conf.Tenant,
+		user:   conf.User,
+		pass:   conf.Pass,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: damTimeout,
+			},
+		},
+	}
+}
+
+func (c *damClient) url(cont, object string, query string) string {
+	u := c.base + "/v1/" + url.PathEscape(c.tenant) + "/" + url.PathEscape(cont)
+	if object != "" {
+		u += "/" + (&url.URL{Path: object}).EscapedPath()
+	}
+	if query != "" {
+		u += "?" + query
+	}
+	return u
+}
+
+// newRequest creates a request which times out after timeout.
+func (c *damClient) newRequest(method, url string, body io.Reader, timeout time.Duration) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(c.user, c.pass)
+	req.Header.Set("X-Tenant", c.tenant)
+	return req, cancel, nil
+}
+
+func (c *damClient) do(req *http.Request, op, cont, object string) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return &DamError{
+			Op:     op,
+			Cont:   cont,
+			Object: object,
+			Status: resp.StatusCode,
+			Msg:    strings.TrimSpace(string(b)),
+		}
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (c *damClient) PutObject(cont, object, file string, meta map[string]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	timeout := damTimeout + time.Duration(info.Size()/damMinRate)*time.Second
+	req, cancel, err := c.newRequest("PUT", c.url(cont, object, ""), f, timeout)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range meta {
+		req.Header.Set("X-Object-Meta-"+k, v)
+	}
+
+	return c.do(req, "putObject", cont, object)
+}
+
+func (c *damClient) Stat(cont, object string) (ObjectInfo, error) {
+	req, cancel, err := c.newRequest("HEAD", c.url(cont, object, ""), nil, damTimeout)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer cancel()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return ObjectInfo{}, &DamError{
+			Op:     "stat",
+			Cont:   cont,
+			Object: object,
+			Status: resp.StatusCode,
+			Msg:    resp.Status,
+		}
+	}
+
+	info := ObjectInfo{
+		Size: resp.ContentLength,
+		Meta: make(map[string]string),
+	}
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "X-Object-Meta-") {
+			key := strings.ToLower(strings.TrimPrefix(k, "X-Object-Meta-"))
+			info.Meta[key] = resp.Header.Get(k)
+		}
+	}
+	return info, nil
+}
+
+func (c *damClient) Sync(cont string) error {
+	req, cancel, err := c.newRequest("POST", c.url(cont, "", "sync"), nil, damTimeout)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	return c.do(req, "sync", cont, "")
+}
+
+// dacliUploader runs the external dacli binary.
+type dacliUploader struct {
+	conf Config
+}
+
+func (d *dacliUploader) PutObject(cont, object, file string, meta map[string]string) error {
+	args := []string{
+		"putObject",
+		"-p", d.conf.Dam,
+		"-t", d.conf.Tenant,
+		"-u", d.conf.User,
+		"-c", cont,
+		"-f", file,
+		"-o", object,
+	}
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--xdata", k+"="+meta[k])
+	}
+
+	return cmdExecutor(dacliCommand(d.conf, args...))
+}
+
+// Stat is not supported by dacli, objects are not verified.
+func (d *dacliUploader) Stat(cont, object string) (ObjectInfo, error) {
+	return ObjectInfo{}, errNotSupported
+}
+
+func (d *dacliUploader) Sync(cont string) error {
+	args := []string{
+		"sync",
+		"-p", d.conf.Dam,
+		"-t", d.conf.Tenant,
+		"-u", d.conf.User,
+		"-c", cont,
+		"--sync",
+	}
+
+	return cmdExecutor(dacliCommand(d.conf, args...))
+}
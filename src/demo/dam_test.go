@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+)
+
+// fakeDam is a DAM endpoint in memory, in the layout of damClient.
+type fakeDam struct {
+	mu      gosync.Mutex
+	objects map[string][]byte            // key: container/object
+	meta    map[string]map[string]string // key: container/object
+	synced  []string
+}
+
+func newFakeDam() *fakeDam {
+	return &fakeDam{
+		objects: make(map[string][]byte),
+		meta:    make(map[string]map[string]string),
+	}
+}
+
+func (d *fakeDam) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != "system" || pass != "secret" {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+		return
+	}
+
+	// /v1/<tenant>/<container>[/<object>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/"), "/", 3)
+	if len(parts) < 2 || parts[0] != r.Header.Get("X-Tenant") {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	key := strings.Join(parts[1:], "/")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case r.Method == "PUT" && len(parts) == 3:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		meta := make(map[string]string)
+		for k := range r.Header {
+			if strings.HasPrefix(k, "X-Object-Meta-") {
+				meta[k] = r.Header.Get(k)
+			}
+		}
+		d.objects[key] = b
+		d.meta[key] = meta
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "HEAD" && len(parts) == 3:
+		b, ok := d.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range d.meta[key] {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+
+	case r.Method == "POST" && len(parts) == 2 && r.URL.RawQuery == "sync":
+		d.synced = append(d.synced, parts[1])
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func newTestDamClient(t *testing.T, pass string) (*damClient, *fakeDam) {
+	dam := newFakeDam()
+	server := httptest.NewServer(dam)
+	t.Cleanup(server.Close)
+
+	conf := Config{Dam: server.URL, Tenant: "da", User: "system", Pass: pass}
+	return newDamClient(conf), dam
+}
+
+func TestDamClient(t *testing.T) {
+	c, dam := newTestDamClient(t, "secret")
+
+	file := filepath.Join(t.TempDir(), "a.mp4")
+	if err := ioutil.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.PutObject("hello", "dir/a b.mp4", file, map[string]string{MetaChecksum: "123"})
+	if err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	if got := string(dam.objects["hello/dir/a b.mp4"]); got != "hello" {
+		t.Errorf("object = %q, want %q", got, "hello")
+	}
+
+	info, err := c.Stat("hello", "dir/a b.mp4")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != 5 || info.Meta[strings.ToLower(MetaChecksum)] != "123" {
+		t.Errorf("Stat = %+v, want size 5 and checksum 123", info)
+	}
+
+	if err := c.Sync("hello"); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if len(dam.synced) != 1 || dam.synced[0] != "hello" {
+		t.Errorf("synced = %v, want [hello]", dam.synced)
+	}
+}
+
+func TestDamClientError(t *testing.T) {
+	c, _ := newTestDamClient(t, "wrong")
+
+	err := c.Sync("hello")
+	de, ok := err.(*DamError)
+	if !ok {
+		t.Fatalf("Sync error = %v, want *DamError", err)
+	}
+	if de.Status != http.StatusUnauthorized || de.Op != "sync" || de.Cont != "hello" {
+		t.Errorf("Sync error = %+v", de)
+	}
+
+	if _, err := c.Stat("hello", "missing"); err == nil {
+		t.Error("Stat of missing object succeeded")
+	}
+}
+
+// The password is passed to dacli in environment by default, the
+// environment it is read from is not inherited.
+func TestDacliPassEnv(t *testing.T) {
+	t.Setenv("TEST_DAM_PASS", "secret")
+	t.Cleanup(func() { delete(envPass.pass, "TEST_DAM_PASS") })
+
+	conf := defaultConf()
+	conf.PassEnv = "TEST_DAM_PASS"
+	pass, err := resolvePass(conf)
+	if err != nil || pass != "secret" {
+		t.Fatalf("resolvePass = %q, %v", pass, err)
+	}
+	if _, ok := os.LookupEnv("TEST_DAM_PASS"); ok {
+		t.Error("environment of password not unset")
+	}
+	if pass, err := resolvePass(conf); err != nil || pass != "secret" {
+		t.Errorf("resolvePass again = %q, %v", pass, err)
+	}
+
+	conf.Pass = pass
+	cmd := dacliCommand(conf, "upload", "a.mp4")
+	for _, arg := range cmd.Args {
+		if arg == pass {
+			t.Errorf("password in argv %v", cmd.Args)
+		}
+	}
+	if env := cmd.Env[len(cmd.Env)-1]; env != DefaultDacliPassVar+"=secret" {
+		t.Errorf("environment of dacli = %q", env)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultStateDir string = "/var/lib/demo"
+
+// the upper limit of retry interval
+const maxBackoff = 5 * time.Minute
+
+// the level of requests retrying dead letter files, below the
+// batches of new files
+const DeadLevel int = -20
+
+// deadEntry is a file which failed to upload after all retries.
+type deadEntry struct {
+	Root  string    `json:"root,omitempty"` // samba directory of file
+	Cont  string    `json:"container"`
+	Err   string    `json:"error"`
+	Count int       `json:"count"` // number of failed batches
+	Time  time.Time `json:"time"`
+}
+
+// deadLetter keeps failed files on disk, so that they can be
+// uploaded again after the next batch or after restart.
+type deadLetter struct {
+	mu    gosync.Mutex
+	path  string
+	log   *Logger
+	Files map[string]deadEntry `json:"files"`
+}
+
+func stateDir(conf Config) string {
+	if conf.StateDir == "" {
+		return DefaultStateDir
+	}
+	return conf.StateDir
+}
+
+func loadDeadLetter(dir string, log *Logger) (*deadLetter, error) {
+	d := &deadLetter{
+		path:  filepath.Join(dir, "deadletter.json"),
+		log:   log,
+		Files: make(map[string]deadEntry),
+	}
+
+	bytes, err := ioutil.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return d, err
+	}
+
+	err = json.Unmarshal(bytes, d)
+	if err != nil {
+		return d, err
+	}
+	if d.Files == nil {
+		d.Files = make(map[string]deadEntry)
+	}
+
+	d.log.Info("dead letter files", "count", len(d.Files))
+	return d, nil
+}
+
+func (d *deadLetter) save() error {
+	err := os.MkdirAll(filepath.Dir(d.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.MarshalIndent(d, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that a crash
+	// never leaves a truncated queue behind
+	tmp := d.path + ".tmp"
+	err = ioutil.WriteFile(tmp, bytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+func (d *deadLetter) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.Files)
+}
+
+func (d *deadLetter) Add(root, file, cont string, e error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry := d.Files[file]
+	entry.Root = root
+	entry.Cont = cont
+	entry.Err = e.Error()
+	entry.Count++
+	entry.Time = time.Now()
+	d.Files[file] = entry
+
+	d.log.Warn("add to dead letter", "file", file, "container", cont, "count", entry.Count, "error", e)
+	if err := d.save(); err != nil {
+		d.log.Error("fail to save dead letter", "error", err)
+	}
+}
+
+func (d *deadLetter) Remove(file string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.remove(file)
+}
+
+func (d *deadLetter) remove(file string) {
+	if _, ok := d.Files[file]; !ok {
+		return
+	}
+
+	delete(d.Files, file)
+	d.log.Info("remove from dead letter", "file", file)
+	if err := d.save(); err != nil {
+		d.log.Error("fail to save dead letter", "error", err)
+	}
+}
+
+// Retry returns the dead files to upload again by their samba
+// directory, dropping files which no longer exist. Files added
+// without a directory are in samba.
+func (d *deadLetter) Retry(samba string) map[string][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var dead []string
+	for file := range d.Files {
+		dead = append(dead, file)
+	}
+	sort.Strings(dead)
+
+	files := make(map[string][]string)
+	for _, file := range dead {
+		root := d.Files[file].Root
+		if root == "" {
+			root = samba
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(file))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			d.log.Warn("dead file not exist", "file", path)
+			d.remove(file)
+			continue
+		}
+
+		d.log.Info("retry dead file", "file", file, "dir", root)
+		files[root] = append(files[root], file)
+	}
+
+	return files
+}
+
+// queueDead queues the dead files as requests of DeadLevel, one of
+// each samba directory, unless some are queued already.
+func (p *pipeline) queueDead() {
+	if !atomic.CompareAndSwapInt32(&p.deadQueued, 0, 1) {
+		return
+	}
+
+	dead := p.deadq.Retry(p.getConf().Samba)
+	atomic.AddInt32(&p.deadQueued, int32(len(dead)-1))
+	for root, files := range dead {
+		req := Request{Level: DeadLevel, Root: root, Files: files, Dead: true}
+		req.Id = p.jnl.Push(req)
+		p.log.Info("queue dead letter request", "batch", req.Id, "level", req.Level, "dir", root, "files", req.Files)
+		p.queue.Push(req, p.getConf().Priority.Aging)
+	}
+}
+
+// uploadRetry uploads file, retrying with exponential backoff.
+func (p *pipeline) uploadRetry(root, file, cont string) error {
+	conf := p.getConf()
+	backoff := time.Duration(conf.Backoff) * time.Second
+
+	var err error
+	for i := 0; i <= conf.Retry; i++ {
+		if i > 0 {
+			p.log.Warn("retry upload", "file", file, "container", cont, "attempt", i, "retry", conf.Retry, "backoff", backoff)
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+
+		err = p.upload(root, file, cont)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
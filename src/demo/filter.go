@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FilterConfig selects the files to upload. Exclude rules win over
+// include rules, a file is included if no include rule is given.
+//
+// A glob without "/" matches the base name of file, otherwise the
+// path relative to samba directory; so does an extension. Regexes
+// match the relative path.
+type FilterConfig struct {
+	Include   []string `json:"include,omitempty"`    // globs
+	Exclude   []string `json:"exclude,omitempty"`    // globs
+	IncludeRe []string `json:"include_re,omitempty"` // regexes
+	ExcludeRe []string `json:"exclude_re,omitempty"` // regexes
+	Ext       []string `json:"ext,omitempty"`        // extensions included, e.g. ".mp4"
+	MinSize   int64    `json:"min_size,omitempty"`   // bytes
+	MaxSize   int64    `json:"max_size,omitempty"`   // bytes, 0 for no limit
+}
+
+// fileFilter is FilterConfig with compiled regexes.
+type fileFilter struct {
+	conf      FilterConfig
+	includeRe []*regexp.Regexp
+	excludeRe []*regexp.Regexp
+	log       *Logger // decisions are logged at debug level
+}
+
+func newFilter(conf FilterConfig, log *Logger) (*fileFilter, error) {
+	f := &fileFilter{conf: conf, log: log}
+	for _, s := range conf.IncludeRe {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		f.includeRe = append(f.includeRe, re)
+	}
+	for _, s := range conf.ExcludeRe {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		f.excludeRe = append(f.excludeRe, re)
+	}
+	return f, nil
+}
+
+// matchGlob matches file, relative to samba directory, with a glob.
+func matchGlob(pattern, file string) bool {
+	name := file
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(file)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// Name decides by the name of file, relative to samba directory.
+func (f *fileFilter) Name(file string) bool {
+	for _, p := range f.conf.Exclude {
+		if matchGlob(p, file) {
+			f.log.Debug("exclude file", "file", file, "glob", p)
+			return false
+		}
+	}
+	for _, re := range f.excludeRe {
+		if re.MatchString(file) {
+			f.log.Debug("exclude file", "file", file, "regex", re)
+			return false
+		}
+	}
+
+	if len(f.conf.Ext) > 0 {
+		ext := path.Ext(file)
+		var ok bool
+		for _, e := range f.conf.Ext {
+			if strings.EqualFold(e, ext) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			f.log.Debug("exclude file", "file", file, "ext", ext)
+			return false
+		}
+	}
+
+	if len(f.conf.Include) == 0 && len(f.includeRe) == 0 {
+		f.log.Debug("include file", "file", file)
+		return true
+	}
+	for _, p := range f.conf.Include {
+		if matchGlob(p, file) {
+			f.log.Debug("include file", "file", file, "glob", p)
+			return true
+		}
+	}
+	for _, re := range f.includeRe {
+		if re.MatchString(file) {
+			f.log.Debug("include file", "file", file, "regex", re)
+			return true
+		}
+	}
+	f.log.Debug("exclude file", "file", file, "reason", "no include rule matched")
+	return false
+}
+
+// Size decides by the size of file. It is decided when the file is
+// completely written, the size is not known when the file is created.
+func (f *fileFilter) Size(file string, size int64) bool {
+	if size < f.conf.MinSize {
+		f.log.Debug("exclude file", "file", file, "size", size, "min_size", f.conf.MinSize)
+		return false
+	}
+	if f.conf.MaxSize > 0 && size > f.conf.MaxSize {
+		f.log.Debug("exclude file", "file", file, "size", size, "max_size", f.conf.MaxSize)
+		return false
+	}
+	return true
+}
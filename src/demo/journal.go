@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+)
+
+// operation of journal record
+const (
+	OpSeq     string = "seq"
+	OpRequest string = "request"
+	OpCont    string = "container"
+	OpUpload  string = "upload"
+	OpSync    string = "sync"
+	OpDone    string = "done"
+)
+
+type journalRecord struct {
+	Op    string   `json:"op"`
+	Id    int      `json:"id"`
+	Level int      `json:"level,omitempty"`
+	Root  string   `json:"root,omitempty"`
+	Files []string `json:"files,omitempty"`
+	Dead  bool     `json:"dead,omitempty"`
+	File  string   `json:"file,omitempty"`
+	Cont  string   `json:"cont,omitempty"`
+}
+
+// batch is the state of a request which is not done yet.
+type batch struct {
+	Req      Request
+	Cont     string
+	Uploaded map[string]bool
+	Synced   bool
+}
+
+// journal is an append-only log of requests and the progress of
+// uploading and syncing them. It is replayed at startup, so that
+// batches interrupted by a crash or restart are handled again.
+type journal struct {
+	mu      gosync.Mutex
+	path    string
+	file    *os.File
+	seq     int
+	batches map[int]*batch
+	log     *Logger
+}
+
+func openJournal(dir string, log *Logger) (*journal, error) {
+	j := &journal{
+		path:    filepath.Join(dir, "journal.log"),
+		log:     log,
+		batches: make(map[int]*batch),
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = j.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	j.log.Info("journal open batches", "count", len(j.batches))
+	return j, nil
+}
+
+// replay applies the records in journal, and truncates a last record
+// partly written by a crash, so that the next one starts a new line.
+func (j *journal) replay() error {
+	f, err := os.OpenFile(j.path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var end int64 // after the last complete record
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		end += int64(len(line))
+
+		var r journalRecord
+		err = json.Unmarshal(line, &r)
+		if err != nil {
+			j.log.Warn("invalid journal record", "error", err)
+			continue
+		}
+		j.apply(r)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > end {
+		j.log.Warn("truncate partial journal record", "offset", end, "size", info.Size())
+		return f.Truncate(end)
+	}
+	return nil
+}
+
+func (j *journal) apply(r journalRecord) {
+	if r.Id > j.seq {
+		j.seq = r.Id
+	}
+
+	if r.Op == OpRequest {
+		j.batches[r.Id] = &batch{
+			Req:      Request{Id: r.Id, Level: r.Level, Root: r.Root, Files: r.Files, Dead: r.Dead},
+			Uploaded: make(map[string]bool),
+		}
+		return
+	}
+
+	b, ok := j.batches[r.Id]
+	if !ok {
+		return
+	}
+
+	switch r.Op {
+	case OpCont:
+		b.Cont = r.Cont
+	case OpUpload:
+		b.Uploaded[r.File] = true
+	case OpSync:
+		b.Synced = true
+	case OpDone:
+		delete(j.batches, r.Id)
+	}
+}
+
+func (j *journal) write(r journalRecord) {
+	j.apply(r)
+
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		j.log.Error("fail to marshal journal record", "batch", r.Id, "error", err)
+		return
+	}
+
+	_, err = j.file.Write(append(bytes, '\n'))
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		j.log.Error("journal error", "batch", r.Id, "error", err)
+	}
+}
+
+// compact truncates the journal when no batch is open,
+// keeping only the sequence number.
+func (j *journal) compact() {
+	if len(j.batches) > 0 {
+		return
+	}
+
+	err := j.file.Truncate(0)
+	if err != nil {
+		j.log.Error("journal error", "error", err)
+		return
+	}
+	j.write(journalRecord{Op: OpSeq, Id: j.seq})
+}
+
+// Push records a new request and returns its id.
+func (j *journal) Push(req Request) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	j.write(journalRecord{Op: OpRequest, Id: j.seq, Level: req.Level, Root: req.Root, Files: req.Files, Dead: req.Dead})
+	return j.seq
+}
+
+// Open returns the requests which are not done, in order of id.
+func (j *journal) Open() []Request {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var reqs []Request
+	for _, b := range j.batches {
+		reqs = append(reqs, b.Req)
+	}
+	sort.Slice(reqs, func(a, b int) bool { return reqs[a].Id < reqs[b].Id })
+	return reqs
+}
+
+func (j *journal) Cont(id int) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if b, ok := j.batches[id]; ok {
+		return b.Cont
+	}
+	return ""
+}
+
+func (j *journal) SetCont(id int, cont string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.write(journalRecord{Op: OpCont, Id: id, Cont: cont})
+}
+
+func (j *journal) Uploaded(id int, file string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if b, ok := j.batches[id]; ok {
+		return b.Uploaded[file]
+	}
+	return false
+}
+
+func (j *journal) Upload(id int, file string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.write(journalRecord{Op: OpUpload, Id: id, File: file})
+}
+
+func (j *journal) Synced(id int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if b, ok := j.batches[id]; ok {
+		return b.Synced
+	}
+	return false
+}
+
+func (j *journal) Sync(id int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.write(journalRecord{Op: OpSync, Id: id})
+}
+
+func (j *journal) Done(id int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.write(journalRecord{Op: OpDone, Id: id})
+	j.compact()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A record partly written by a crash must not swallow the next one.
+func TestJournalPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	log := &Logger{level: LevelError, format: FormatText, out: ioutil.Discard}
+
+	j, err := openJournal(dir, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Push(Request{Files: []string{"a.mp4"}})
+	j.file.Close()
+
+	// crash in the middle of appending a record
+	f, err := os.OpenFile(filepath.Join(dir, "journal.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"request","id":2,"fil`)
+	f.Close()
+
+	j, err = openJournal(dir, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := j.Push(Request{Files: []string{"b.mp4"}}); id != 2 {
+		t.Errorf("Push = %d, want 2", id)
+	}
+	j.file.Close()
+
+	j, err = openJournal(dir, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.file.Close()
+	reqs := j.Open()
+	if len(reqs) != 2 || reqs[0].Files[0] != "a.mp4" || reqs[1].Files[0] != "b.mp4" {
+		t.Errorf("Open = %+v, want requests of a.mp4 and b.mp4", reqs)
+	}
+}
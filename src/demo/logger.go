@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+type Level int
+
+// log level
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+func parseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %s", s)
+}
+
+// log format
+const (
+	FormatText string = "text" // key=value
+	FormatJSON string = "json"
+)
+
+// LogConfig is the configuration of logging.
+type LogConfig struct {
+	Level   string `json:"level"`              // debug, info, warn or error
+	Format  string `json:"format"`             // text or json
+	File    string `json:"file,omitempty"`     // empty for stderr
+	MaxSize int    `json:"max_size,omitempty"` // megabytes before rotation
+	Rotate  int    `json:"rotate,omitempty"`   // hours before rotation
+	Backups int    `json:"backups,omitempty"`  // rotated files kept
+	MaxAge  int    `json:"max_age,omitempty"`  // days rotated files kept
+}
+
+// Logger writes leveled records with key-value fields.
+type Logger struct {
+	mu      gosync.Mutex
+	level   Level
+	format  string
+	out     io.Writer // nil to write to parent
+	conf    LogConfig
+	parent  *Logger         // logger of process, for a pipeline logger
+	fields  []interface{}   // added to every record
+	secrets map[string]bool // field values redacted in every record
+}
+
+var logger = &Logger{level: LevelInfo, format: FormatText, out: os.Stderr}
+
+func init() {
+	// output of standard log package, e.g. errors of http server
+	log.SetFlags(0)
+	log.SetOutput(logWriter{level: LevelWarn})
+}
+
+// With returns a logger which adds kv to every record. It writes to
+// l, unless configured with a file of its own.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return &Logger{level: l.level, format: l.format, parent: l, fields: kv}
+}
+
+// Configure applies conf, it can be called again on reload.
+func (l *Logger) Configure(conf LogConfig) error {
+	level, err := parseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+
+	format := conf.Format
+	if format == "" {
+		format = FormatText
+	}
+
+	var parentFile string
+	if l.parent != nil {
+		parentFile = l.parent.file()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.parent != nil && (conf.File == "" || conf.File == parentFile) {
+		// the same file as parent, or stderr
+		if c, ok := l.out.(io.Closer); ok {
+			c.Close()
+		}
+		l.out = nil
+	} else if conf.File != l.conf.File || conf.MaxSize != l.conf.MaxSize ||
+		conf.Rotate != l.conf.Rotate || conf.Backups != l.conf.Backups ||
+		conf.MaxAge != l.conf.MaxAge || l.out == nil {
+		var out io.Writer = os.Stderr
+		if conf.File != "" {
+			w, err := newRotateWriter(conf)
+			if err != nil {
+				return err
+			}
+			out = w
+		}
+
+		if c, ok := l.out.(io.Closer); ok {
+			c.Close()
+		}
+		l.out = out
+	}
+
+	l.level = level
+	l.format = format
+	l.conf = conf
+	return nil
+}
+
+func (l *Logger) file() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.conf.File
+}
+
+// Redact adds secrets, which are redacted as whole values of fields,
+// or elements and fields of them, never as a part of text.
+func (l *Logger) Redact(secrets ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.secrets == nil {
+		l.secrets = make(map[string]bool)
+	}
+	for _, s := range secrets {
+		if s != "" {
+			l.secrets[s] = true
+		}
+	}
+}
+
+// isSecret reports whether s is a secret of l or its parent.
+func (l *Logger) isSecret(s string) bool {
+	l.mu.Lock()
+	secret := l.secrets[s]
+	l.mu.Unlock()
+
+	return secret || l.parent != nil && l.parent.isSecret(s)
+}
+
+// Redacted returns a copy of v with the strings equal to a secret
+// redacted, in lists, maps and structs too, e.g. a configuration.
+func (l *Logger) Redacted(v interface{}) interface{} {
+	if err, ok := v.(error); ok {
+		if l.isSecret(err.Error()) {
+			return redacted
+		}
+		return v
+	}
+	if v == nil {
+		return nil
+	}
+	return l.redactValue(reflect.ValueOf(v)).Interface()
+}
+
+func (l *Logger) redactValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.String:
+		if l.isSecret(v.String()) {
+			return reflect.ValueOf(redacted).Convert(v.Type())
+		}
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < c.NumField(); i++ {
+			if f := c.Field(i); f.CanSet() {
+				f.Set(l.redactValue(f))
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(l.redactValue(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), l.redactValue(iter.Value()))
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(l.redactValue(v.Elem()))
+		return c
+	}
+	return v
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.output(2, LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.output(2, LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.output(2, LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.output(2, LevelError, msg, kv) }
+
+// Fatal logs at error level and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.output(2, LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// output writes a record, kv is a list of alternate keys and values.
+func (l *Logger) output(depth int, level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	kv = append(append(make([]interface{}, 0, len(l.fields)+len(kv)), l.fields...), kv...)
+	for i := 1; i < len(kv); i += 2 {
+		kv[i] = l.Redacted(kv[i])
+	}
+	if level >= LevelError {
+		recordError(msg, kv)
+	}
+
+	caller := "???:0"
+	if _, file, line, ok := runtime.Caller(depth); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	now := time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+
+	l.mu.Lock()
+	format := l.format
+	l.mu.Unlock()
+
+	var buf bytes.Buffer
+	if format == FormatJSON {
+		rec := map[string]interface{}{
+			"time":   now,
+			"level":  level.String(),
+			"caller": caller,
+			"msg":    msg,
+		}
+		for i := 0; i < len(kv); i += 2 {
+			rec[fieldKey(kv, i)] = jsonValue(fieldValue(kv, i))
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			b = []byte(strconv.Quote(fmt.Sprint(rec)))
+		}
+		buf.Write(b)
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s %s", now, strings.ToUpper(level.String()), caller, msg)
+		for i := 0; i < len(kv); i += 2 {
+			buf.WriteString(" " + fieldKey(kv, i) + "=" + textValue(fieldValue(kv, i)))
+		}
+	}
+	buf.WriteByte('\n')
+	l.write(buf.String())
+}
+
+// write writes a record to the output of l, or of its parent.
+func (l *Logger) write(rec string) {
+	if l.parent != nil {
+		l.mu.Lock()
+		out := l.out
+		l.mu.Unlock()
+
+		if out == nil {
+			l.parent.write(rec)
+			return
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	io.WriteString(l.out, rec)
+}
+
+func fieldKey(kv []interface{}, i int) string {
+	if s, ok := kv[i].(string); ok {
+		return s
+	}
+	return fmt.Sprint(kv[i])
+}
+
+func fieldValue(kv []interface{}, i int) interface{} {
+	if i+1 < len(kv) {
+		return kv[i+1]
+	}
+	return "(missing)"
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// logWriter passes the output of standard log package to logger.
+type logWriter struct {
+	level Level
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	logger.output(4, w.level, strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// A short password is redacted as a whole value only, never in text.
+func TestRedactWholeValue(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{level: LevelInfo, format: FormatText, out: &buf}
+	l.Redact("123456")
+
+	conf := Config{Pass: "123456", Conts: []string{"c123456"}}
+	l.With("pipeline", "p1").Info("file 123456.mp4 uploaded",
+		"file", "123456.mp4",
+		"options", []string{"-u", "system", "-P", "123456"},
+		"err", errors.New("123456"),
+		"config", conf)
+
+	rec := buf.String()
+	for _, want := range []string{"file 123456.mp4 uploaded", "file=123456.mp4", "[-u system -P ******]", "err=******", "******", "c123456"} {
+		if !strings.Contains(rec, want) {
+			t.Errorf("record %q does not contain %q", rec, want)
+		}
+	}
+	if strings.Count(rec, "123456") != 3 {
+		t.Errorf("record %q, want 123456 in message, file and container only", rec)
+	}
+	if conf.Pass != "123456" {
+		t.Errorf("password of logged config changed to %q", conf.Pass)
+	}
+}
@@ -1,38 +1,74 @@
-// 1. add log file
-// 2. log level
-// 2. add log rotation
-// 3. add line number
-// 5. send message: tcp
 // 6. error handling
 // 7. panic handle
 // 8. how to test code
-// 9. support file filter: exclude
 
 package main
 
 import (
-	"encoding/gob"
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"io/ioutil"
-	"log"
-	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Config struct {
 	Cool   int      `json:"cool"`
-	Tcp    string   `json:"tcp,omitempty"`
+	Tcp    string   `json:"tcp,omitempty"` // gob target if no targets
 	Udp    string   `json:"udp,omitempty"`
 	Conts  []string `json:"container"`
 	Dam    string   `json:"dam"`
 	Tenant string   `json:"tenant"`
 	User   string   `json:"user"`
-	Pass   string   `json:"pass"`
+	Pass   string   `json:"pass,omitempty"` // plaintext, prefer the sources below
 	Samba  string   `json:"samba"`
 	Gap    int      `json:"gap"`
+
+	PassEnv      string   `json:"pass_env,omitempty"`       // environment of password
+	PassFile     string   `json:"pass_file,omitempty"`      // file of password, mode 0600 or 0400
+	PassCmd      []string `json:"pass_cmd,omitempty"`       // command printing password
+	DacliPass    string   `json:"dacli_pass,omitempty"`     // how dacli gets password: env, stdin or argv
+	DacliPassVar string   `json:"dacli_pass_var,omitempty"` // environment of password read by dacli, default DACLI_PASSWORD
+
+	passErr error // failure to get password, reported by validateConf
+
+	Backend  string `json:"backend,omitempty"` // dacli or dam
+	Retry    int    `json:"retry"`             // retries of each file
+	Backoff  int    `json:"backoff"`           // seconds before the first retry
+	StateDir string `json:"state,omitempty"`
+	Workers  int    `json:"workers"`           // files uploaded in parallel
+	Checksum string `json:"checksum"`          // md5 or sha256 with backend dam, empty to disable
+	Shutdown int    `json:"shutdown"`          // seconds to wait for the current batch
+	Admin    string `json:"admin,omitempty"`   // listen address of admin api
+	Metrics  string `json:"metrics,omitempty"` // listen address of metrics
+
+	Targets    []Target `json:"targets,omitempty"`  // signal targets, udp and tcp are used if empty
+	Protocol   string   `json:"protocol,omitempty"` // signal protocol of udp: raw or reliable
+	AckTimeout int      `json:"ack_timeout"`        // milliseconds to wait for an ack
+	Retransmit int      `json:"retransmit"`         // retransmissions of an unacknowledged signal
+
+	Watcher string         `json:"watcher,omitempty"` // fsnotify or poll
+	Poll    int            `json:"poll,omitempty"`    // seconds between scans of poll watcher
+	Select  string         `json:"select,omitempty"`  // strategy of container selection
+	Weights map[string]int `json:"weights,omitempty"` // weights of containers, 1 by default
+	Stable  StableConfig   `json:"stable"`
+	Filter  FilterConfig   `json:"filter"`
+
+	Priority PriorityConfig `json:"priority"`
+
+	Name      string           `json:"name,omitempty"`      // name of pipeline
+	Pipelines []PipelineConfig `json:"pipelines,omitempty"` // pipelines overriding the fields above
+
+	Log LogConfig `json:"log"`
 }
 
 // file status
@@ -60,29 +96,12 @@ const (
 
 const ConfPath string = "/etc/demo/demo.conf"
 
-var msgInfo = make(map[string]string)
-var config Config
+// configuration file, searched if not given, see findConf
+var confPath string
 
-var enable bool = false
-var isDataVary = false
+var msgInfo = make(map[string]string)
 
 func init() {
-	// load configration
-	var err error
-	config, err = loadConf()
-	if err != nil {
-		log.Println("error:", err)
-		return
-	}
-
-	// TODO: verify configuration
-	if len(config.Conts) == 0 {
-		log.Println("error: no container available")
-		return
-	}
-
-	log.Println("configration:", config)
-
 	// generate msgInfo
 	msgInfo[WaitStart] = "start to wait"
 	msgInfo[StreamStart] = "data varying"
@@ -98,346 +117,778 @@ func init() {
 	msgInfo[SyncErr] = "sync error"
 }
 
-func monitor(done <-chan bool, chReq chan<- Request) {
-	watcher, err := fsnotify.NewWatcher()
+// setup loads configuration, and state of pipelines before running.
+func setup() {
+	// load configration
+	config, err := loadConf()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("fail to load config", "error", err)
 	}
-	defer watcher.Close()
 
-	log.Println("watch file: ", config.Samba)
-	err = watcher.Add(config.Samba)
+	// verify configuration, refuse to start on any problem
+	err = validateConf(config)
+	if errs, ok := err.(ConfErrors); ok {
+		for _, e := range errs {
+			logger.Error("config error", "field", e.Field, "error", e.Msg)
+		}
+		os.Exit(1)
+	}
+
+	err = logger.Configure(config.Log)
+	if err != nil {
+		logger.Fatal("fail to configure log", "error", err)
+	}
+	logger.Info("configration", "config", config)
+
+	setConf(config)
+
+	confs, err := pipelineConfs(config)
+	if err != nil {
+		logger.Fatal("fail to load pipelines", "error", err)
+	}
+	for _, conf := range confs {
+		p, err := newPipeline(conf)
+		if err != nil {
+			logger.Fatal("fail to create pipeline", "pipeline", conf.Name, "error", err)
+		}
+		pipelines = append(pipelines, p)
+	}
+}
+
+func (p *pipeline) monitor(done <-chan bool) {
+	// a failure stops this pipeline only, the handler goes on
+	// with requests already queued
+	watcher, err := newWatcher(p.getConf())
 	if err != nil {
-		log.Fatal(err)
+		p.show.Fail(err)
+		p.log.Error("fail to create watcher, monitor stopped", "error", err)
+		return
 	}
+	defer watcher.Close()
 
 	pending := make(map[string]int)
+	dirs := make(map[string]bool)
+	stab := newStability(p)
 	var waitTime int
 
+	root := p.getConf().Samba
+	p.root = root
+	p.log.Info("watch file", "dir", root)
+	err = p.watchTree(watcher, dirs, root, nil)
+	if err != nil {
+		p.show.Fail(err)
+		p.log.Error("fail to watch, monitor stopped", "dir", root, "error", err)
+		return
+	}
+
+	// files not completely written at last exit
+	files, err := loadPending(stateDir(p.getConf()))
+	if err != nil {
+		p.log.Error("fail to load pending files", "error", err)
+	}
+	for _, f := range files {
+		if p.getFilter().Name(f) {
+			pending[f] = New
+		}
+	}
+	if len(files) > 0 {
+		p.log.Info("resume pending files", "files", files)
+	}
+
+	// checkPending checks stability of pending files,
+	// returns the number of files completely written
+	checkPending := func() int {
+		var ready int
+		for k, v := range pending {
+			if v == No {
+				continue
+			}
+			ok, gone := stab.Check(k)
+			if gone {
+				pending[k] = No
+			}
+			if ok && !p.getFilter().Size(k, stab.Size(k)) {
+				pending[k] = No
+				ok = false
+			}
+			if ok {
+				ready++
+			}
+		}
+		return ready
+	}
+
+	// level gives the priority of pending file
+	level := func(file string) int {
+		return p.getPriority().Level(file, stab.Size(file))
+	}
+
+	// emit queues pending files as requests, a request of each level
+	emit := func() {
+		p.show.BatchReady()
+		p.log.Info("cold files", "pending", pending)
+
+		// files not completely written wait for next batch
+		var files []string
+		for k, v := range pending {
+			if v != No && !stab.Ready(k) {
+				continue
+			}
+			if v != No {
+				files = append(files, k)
+			} else {
+				stab.Forget(k)
+			}
+			delete(pending, k)
+		}
+
+		// persist request before queuing it,
+		// the handler may be busy for a long time
+		for i, req := range splitLevel(files, level) {
+			req.Root = root
+			req.Cool = i == 0
+			req.Id = p.jnl.Push(req)
+			metricBatches.Inc(p.name)
+			p.log.Info("queue request", "batch", req.Id, "level", req.Level, "files", req.Files)
+			p.queue.Push(req, p.getConf().Priority.Aging)
+		}
+		p.queueDead()
+
+		// forget the files after their sizes gave the levels
+		for _, f := range files {
+			stab.Forget(f)
+		}
+	}
+
+	exit := make(chan bool)
 	go func() {
+		defer close(exit)
 		for {
 			select {
-			case event := <-watcher.Events:
-				waitTime = 0
-
-				// send the signal once
-				if !isDataVary {
-					if event.Op&fsnotify.Remove != fsnotify.Remove {
-						udpSender(StreamStart)
-					}
-					isDataVary = true
+			case event := <-watcher.Events():
+				// events queued before samba directory changed
+				if !inTree(root, event.Name) {
+					continue
 				}
 
+				waitTime = 0
+				observeEvent(p.name, event.Op)
+				p.show.DataChanged(event.Op&fsnotify.Remove != fsnotify.Remove)
+
 				if event.Op&fsnotify.Create == fsnotify.Create {
-					enable = true
-					log.Println("event:", event)
-					pending[event.Name] = New
+					p.log.Debug("event", "file", event.Name, "op", event.Op)
+
+					// a new directory: watch it and collect the files
+					// created before the watch was added
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						err = p.watchTree(watcher, dirs, event.Name, pending)
+						if err != nil {
+							p.log.Error("fail to watch", "dir", event.Name, "error", err)
+						}
+					} else if p.getFilter().Name(p.relPath(event.Name)) {
+						pending[p.relPath(event.Name)] = New
+					}
 					//log.Println("pending:", pending)
 				}
 
-				if event.Op&fsnotify.Remove == fsnotify.Remove {
-					log.Println("event:", event)
-					pending[event.Name] = No
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					p.log.Debug("event", "file", event.Name, "op", event.Op)
+					if dirs[event.Name] {
+						p.unwatchTree(watcher, dirs, event.Name)
+
+						// files moved away with the directory
+						prefix := p.relPath(event.Name) + "/"
+						for k := range pending {
+							if strings.HasPrefix(k, prefix) {
+								pending[k] = No
+							}
+						}
+					}
+					if event.Op&fsnotify.Remove == fsnotify.Remove {
+						pending[p.relPath(event.Name)] = No
+					}
+					if event.Op&fsnotify.Rename == fsnotify.Rename {
+						// moved out of the tree, or renamed with a
+						// create of the new name
+						delete(pending, p.relPath(event.Name))
+						stab.Forget(p.relPath(event.Name))
+					}
 					//log.Println("pending:", pending)
 				}
 
-				if event.Op&fsnotify.Chmod == fsnotify.Chmod {
-					enable = true
-					log.Println("event:", event)
-					pending[event.Name] = Ready
+				if event.Op&fsnotify.Chmod == fsnotify.Chmod && !dirs[event.Name] {
+					p.log.Debug("event", "file", event.Name, "op", event.Op)
+					if p.getFilter().Name(p.relPath(event.Name)) {
+						pending[p.relPath(event.Name)] = Ready
+					}
 					//log.Println("pending:", pending)
 				}
 
-			case err := <-watcher.Errors:
+			case err := <-watcher.Errors():
 				waitTime = 0
 				if err != nil {
-					udpSender(SymErr)
-					log.Println("error:", err)
+					p.show.Fail(err)
+					p.log.Error("watcher error", "error", err)
 				}
 
 			case <-time.After(time.Second):
 				waitTime += 1
-				isDataVary = false
+				p.show.Quiet()
+				metricPending.Set(len(pending), p.name)
+				p.setPending(len(pending))
 				//log.Println("cool waitTime:", waitTime)
 
-				// add 'enable' to prevent invalid signal,
-				// when starting program
-				/*
-					if waitTime == 1 && enable {
-						udpSender(StreamDone)
-					}
-				*/
-
-				// check length of pending to prevent invalid signal
-				if waitTime == 1+config.Gap && len(pending) > 0 {
-					udpSender(StreamDone)
-					log.Println("cold files:", pending)
-
-					req := Request{Level: 0}
-					for k, v := range pending {
-						if v != No {
-							req.Files = append(req.Files, k)
-						}
-						delete(pending, k)
-					}
-
-					if len(req.Files) > 0 {
-						log.Println("send request:", req)
-						chReq <- req
-					}
+				// check completely written files to prevent invalid
+				// signal, no batch is emitted while paused
+				ready := checkPending()
+				if waitTime >= 1+p.getConf().Gap && ready > 0 && !p.isPaused() {
+					emit()
 				}
 
 				// prevent waitTime to be too large
 				if waitTime >= 2000 {
 					// the reset value should be larger than
 					// condition in which wait signal sended
-					waitTime = 2 + config.Gap
+					waitTime = 2 + p.getConf().Gap
+				}
+
+			case <-p.chFlush:
+				waitTime = 0
+				if checkPending() > 0 {
+					emit()
+				}
+
+			case <-p.chSamba:
+				samba := p.getConf().Samba
+				if samba == root {
+					break
+				}
+
+				// files are relative to the old directory, the
+				// requests queued keep their own
+				p.log.Warn("discard pending files", "pending", pending)
+				pending = make(map[string]int)
+				stab.Reset()
+
+				p.unwatchTree(watcher, dirs, root)
+				root = samba
+				p.root = root
+				p.log.Info("watch file", "dir", root)
+				err := p.watchTree(watcher, dirs, root, nil)
+				if err != nil {
+					p.show.Fail(err)
+					p.log.Error("fail to watch", "dir", root, "error", err)
 				}
 
 			case <-done:
-				log.Println("done")
+				// save files not sent yet, resumed at next start:
+				// completely written files as requests, the others
+				// are checked again
+				var files, unstable []string
+				for k, v := range pending {
+					if v == No {
+						continue
+					}
+					if stab.Ready(k) {
+						files = append(files, k)
+					} else {
+						unstable = append(unstable, k)
+					}
+				}
+				for _, req := range splitLevel(files, level) {
+					req.Root = root
+					req.Id = p.jnl.Push(req)
+					p.log.Info("save pending request", "batch", req.Id, "level", req.Level, "files", req.Files)
+				}
+				err := savePending(stateDir(p.getConf()), unstable)
+				if err != nil {
+					p.log.Error("fail to save pending files", "files", unstable, "error", err)
+				} else if len(unstable) > 0 {
+					p.log.Info("save pending files", "files", unstable)
+				}
+
+				p.log.Info("monitor done")
 				return
 			}
 		}
 	}()
 
-	<-done
+	<-exit
 }
 
-func genConf() error {
-	conf := Config{
-		Cool:   10,
-		Tcp:    "localhost:1234",
-		Udp:    "localhost:1234",
-		Conts:  []string{"hello", "test"},
-		Dam:    "10.2.162.110",
-		Tenant: "da",
-		User:   "system",
-		Pass:   "123456",
-		Samba:  "/tmp/foo",
-		Gap:    3,
-	}
+// watchTree adds a watch for root and every directory below it.
+// If pending is not nil, the regular files found are recorded as new.
+func (p *pipeline) watchTree(watcher Watcher, dirs map[string]bool, root string, pending map[string]int) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the file may be removed during walking
+			p.log.Warn("walk error", "error", err)
+			return nil
+		}
 
-	b, err := json.MarshalIndent(conf, "", "    ")
-	if err != nil {
-		log.Println("error:", err)
-		return err
-	}
+		if !info.IsDir() {
+			if pending != nil && p.getFilter().Name(p.relPath(path)) {
+				pending[p.relPath(path)] = New
+			}
+			return nil
+		}
 
-	os.Stdout.Write(b)
-	return nil
-}
+		if dirs[path] {
+			return nil
+		}
 
-func loadConf() (Config, error) {
-	log.Printf("config file: %s", ConfPath)
+		p.log.Debug("add watch", "dir", path)
+		err = watcher.Add(path)
+		if err != nil {
+			return err
+		}
+		dirs[path] = true
+		return nil
+	})
+}
 
-	if _, err := os.Stat(ConfPath); os.IsNotExist(err) {
-		log.Println("file not exist:", ConfPath)
-		return Config{}, err
+// unwatchTree drops the watches of root and every directory below it.
+func (p *pipeline) unwatchTree(watcher Watcher, dirs map[string]bool, root string) {
+	for dir := range dirs {
+		if inTree(root, dir) {
+			p.log.Debug("remove watch", "dir", dir)
+			// inotify drops the watch of a deleted directory itself,
+			// so the error is expected in that case
+			watcher.Remove(dir)
+			delete(dirs, dir)
+		}
 	}
+}
 
-	bytes, err := ioutil.ReadFile(ConfPath)
-	if err != nil {
-		log.Println("error:", err)
-		return Config{}, err
-	}
+// inTree reports whether path is root or below it.
+func inTree(root, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
 
-	var config Config
-	err = json.Unmarshal(bytes, &config)
+// relPath returns the path of file relative to the samba directory
+// watched, which is also used as the object name.
+func (p *pipeline) relPath(file string) string {
+	rel, err := filepath.Rel(p.root, file)
 	if err != nil {
-		log.Println("error:", err)
-		return Config{}, err
+		return file
 	}
-
-	return config, nil
+	return filepath.ToSlash(rel)
 }
 
-func udpSender(msg string) error {
-	log.Println("send msg via udp:", msg, msgInfo[msg])
-
-	conn, err := net.Dial("udp", config.Udp)
-	if err != nil {
-		log.Println("connect error:", err)
-		return err
+// defaultConf returns the defaults of configuration, overridden by
+// configuration file, environment and command line.
+func defaultConf() Config {
+	return Config{
+		Cool: 10,
+		Udp:  "localhost:1234",
+		Gap:  3,
+
+		DacliPass: DacliPassEnv,
+
+		Backend:  BackendDacli,
+		Retry:    3,
+		Backoff:  2,
+		StateDir: DefaultStateDir,
+		Workers:  4,
+		Checksum: ChecksumNone,
+		Shutdown: 60,
+
+		Protocol:   ProtoRaw,
+		AckTimeout: DefaultAckTimeout,
+		Retransmit: DefaultRetransmit,
+
+		Select:  SelectRoundRobin,
+		Watcher: WatcherFsnotify,
+		Poll:    DefaultPoll,
+		Stable: StableConfig{
+			Window: 5,
+			Temp:   []string{"*.tmp", "*.part", "~$*", ".~lock.*#"},
+		},
+		Filter: FilterConfig{
+			Exclude: []string{"*.tmp", "~$*", "Thumbs.db"},
+		},
+		Priority: PriorityConfig{
+			Aging: DefaultAging,
+		},
+
+		Log: LogConfig{
+			Level:  "info",
+			Format: FormatText,
+		},
 	}
-	defer conn.Close()
+}
 
-	_, err = conn.Write([]byte(msg))
-	if err != nil {
-		log.Println("send error:", err)
+// genConf writes an example configuration to file, or stdout if file is empty.
+func genConf(file string) error {
+	conf := defaultConf()
+	conf.Conts = []string{"hello", "test"}
+	conf.Dam = "10.2.162.110"
+	conf.Tenant = "da"
+	conf.User = "system"
+	conf.Samba = "/tmp/foo"
+	conf.PassFile = "/etc/demo/pass"
+	conf.Admin = "localhost:8081"
+	conf.Metrics = "localhost:9101"
+
+	conf.Targets = []Target{
+		{Name: "controller", Proto: TargetUdp, Addr: "localhost:1234"},
+		{Name: "recorder", Proto: TargetNdjson, Addr: "localhost:1235", Codes: []string{UploadDone, UploadErr, SyncDone, SyncErr}},
+		{Name: "hook", Proto: TargetHttp, Addr: "http://localhost:8080/signal", Codes: []string{SymErr, UploadDone, UploadErr, SyncErr},
+			Headers: map[string]string{"Authorization": "Bearer 123456"}, Secret: "123456", Retry: 3},
+	}
+	conf.Weights = map[string]int{"hello": 1, "test": 1}
+	conf.Priority.Rules = []PriorityRule{
+		{Level: 10, Ext: []string{".xml", ".json"}},
+		{Level: -10, MinSize: 10 << 30},
 	}
-	/*
-		// the length of data sended to windows is 4.
-		// but the length should be 1;
-		err = gob.NewEncoder(conn).Encode(msg)
-		if err != nil {
-			log.Println("send error:", err)
-			return err
-		}
-	*/
-
-	return nil
-}
 
-func tcpSender(msg string) error {
-	log.Println("send msg via tcp:", msg)
+	conf.Log.File = "/var/log/demo/demo.log"
+	conf.Log.MaxSize = 100
+	conf.Log.Rotate = 24
+	conf.Log.Backups = 7
+	conf.Log.MaxAge = 30
 
-	conn, err := net.Dial("tcp", config.Tcp)
+	b, err := json.MarshalIndent(conf, "", "    ")
 	if err != nil {
-		log.Println("connect error:", err)
+		logger.Error("fail to marshal config", "error", err)
 		return err
 	}
-	defer conn.Close()
+	b = append(b, '\n')
+
+	if file == "" {
+		os.Stdout.Write(b)
+		return nil
+	}
 
-	err = gob.NewEncoder(conn).Encode(msg)
+	// the file contains password
+	err = ioutil.WriteFile(file, b, 0600)
 	if err != nil {
-		log.Println("send error:", err)
+		logger.Error("fail to write config", "file", file, "error", err)
 		return err
 	}
-
 	return nil
 }
 
-type Request struct {
-	Level int
-	Files []string // file name
+func loadConf() (Config, error) {
+	config, _, err := loadConfSource()
+	return config, err
 }
 
-func selectCont(lastCont string) string {
-	// verify configuration
-	if lastCont == "" {
-		return config.Conts[0]
+// loadConfSource loads the configuration, and where each field comes from.
+func loadConfSource() (Config, confSource, error) {
+	config, src, err := loadLayers()
+	if err != nil {
+		return Config{}, nil, err
 	}
+	cleanPaths(&config)
+
+	// the password is kept in memory only, a failure is
+	// reported with the other problems of configuration
+	config.Pass, config.passErr = resolvePass(config)
+	src["pass"] = passSource(config, src)
+	logger.Redact(secretsOf(config)...)
+	return config, src, nil
+}
 
-	var newCont string
-	for _, value := range config.Conts {
-		// keep two different containers in config file
-		if lastCont != value {
-			newCont = value
-			break
-		}
-	}
-	return newCont
+type Request struct {
+	Id    int      // batch id, assigned by journal
+	Level int      // priority, see PriorityConfig
+	Root  string   // samba directory of files, which may change on reload
+	Files []string // file name, relative to root
+	Dead  bool     // retry of dead letter files, see queueDead
+	Cool  bool     // the first batch of a cutoff, which waits Config.Cool, not journaled
+}
+
+// selectCont selects the container of next batch, the last one
+// is kept in state directory.
+func (p *pipeline) selectCont() string {
+	return p.history.Select(p.getConf())
 }
 
-func cmdExecutor(name string, arg ...string) error {
-	log.Println("cmd:", name, ", options:", arg)
+func cmdExecutor(cmd *exec.Cmd) error {
+	logger.Debug("cmd", "name", cmd.Path, "options", cmd.Args[1:])
 
-	out, err := exec.Command(name, arg...).Output()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
 	if err != nil {
-		log.Println("error:", err)
+		logger.Error("cmd error", "name", cmd.Path, "error", err, "stderr", strings.TrimSpace(stderr.String()))
 		return err
 	}
 
-	log.Println("result:", string(out))
+	logger.Debug("cmd result", "name", cmd.Path, "output", string(out))
 	return nil
 }
 
-func upload(file, cont string) error {
-	log.Printf("upload file %s to container %s", file, cont)
+// upload uploads file of samba directory root to cont.
+func (p *pipeline) upload(root, file, cont string) error {
+	p.log.Info("upload file", "file", file, "container", cont)
+	start := time.Now()
+
+	conf := p.getConf()
+	path := filepath.Join(root, filepath.FromSlash(file))
+	meta := map[string]string{"use": "demo"}
+
+	var sum string
+	if conf.Checksum != ChecksumNone {
+		var err error
+		sum, err = checksum(path, conf.Checksum)
+		if err != nil {
+			p.log.Error("fail to checksum", "file", file, "error", err)
+			return err
+		}
+		meta[MetaChecksum] = sum
+	}
 
-	name := "dacli"
-	args := []string{
-		"putObject",
-		"-p", config.Dam,
-		"-t", config.Tenant,
-		"-u", config.User,
-		"-P", config.Pass,
-		"-c", cont,
-		"-f", file,
-		"-o", file,
-		"--xdata", "use=demo",
+	err := p.getUploader().PutObject(cont, file, path, meta)
+	if err != nil {
+		p.log.Error("fail to put object", "file", file, "container", cont, "error", err)
+		return err
 	}
 
-	err := cmdExecutor(name, args...)
+	// a mismatched object fails the upload, so that it is retried
+	err = p.verify(cont, file, path, sum)
 	if err != nil {
+		p.log.Error("fail to verify object", "file", file, "container", cont, "error", err)
 		return err
 	}
 
+	metricUploadTime.Observe(since(start), p.name, cont)
+	metricUploaded.Inc(p.name, cont)
+	metricBytes.Add(float64(p.fileSize(root, file)), p.name, cont)
+
 	return nil
 }
 
-func sync(cont string) error {
-	log.Printf("sync container: %s", cont)
-
-	name := "dacli"
-	args := []string{
-		"sync",
-		"-p", config.Dam,
-		"-t", config.Tenant,
-		"-u", config.User,
-		"-P", config.Pass,
-		"-c", cont,
-		"--sync",
-	}
+func (p *pipeline) sync(cont string) error {
+	p.log.Info("sync container", "container", cont)
+	start := time.Now()
 
-	err := cmdExecutor(name, args...)
+	err := p.getUploader().Sync(cont)
+	metricSyncTime.Observe(since(start), p.name, cont)
 	if err != nil {
+		p.log.Error("fail to sync", "container", cont, "error", err)
 		return err
 	}
 
 	return nil
 }
 
-func handler(done <-chan bool, chReq <-chan Request) {
-	log.Println("start handler to handle request")
+func (p *pipeline) handler(done <-chan bool) {
+	p.log.Info("start handler to handle request")
 
-	var cont string
+	// resume batches interrupted in last run, by priority
+	reqs := p.jnl.Open()
+	for _, req := range reqs {
+		p.log.Info("resume request", "batch", req.Id, "level", req.Level, "files", req.Files)
+		if req.Dead {
+			atomic.AddInt32(&p.deadQueued, 1)
+		}
+		p.queue.Push(req, p.getConf().Priority.Aging)
+	}
+
+	// upload files left by last run
+	p.queueDead()
 
 	for {
 		select {
-		case req := <-chReq:
-			log.Println("receive req:", req)
-
-			// 1. select contaienr
-			cont = selectCont(cont)
-			log.Println("select container:", cont)
-
-			// 2. upload files as a batch
-			udpSender(UploadStart)
-			time.Sleep(time.Duration(config.Cool) * time.Second)
-			for _, file := range req.Files {
-				err := upload(file, cont)
-				if err != nil {
-					log.Println("fail to upload file:", file, ", to:", cont)
-				}
+		case <-p.queue.Ready():
+			// the request is journaled, leave it to next start
+			if isDone(done) {
+				p.log.Info("handler done")
+				return
 			}
-			time.Sleep(time.Duration(config.Gap) * time.Second)
-			udpSender(UploadDone)
-
-			// 3. sync
-			udpSender(SyncStart)
-			err := sync(cont)
-			if err != nil {
-				udpSender(SyncErr)
-			} else {
-				udpSender(SyncDone)
+			req, ok := p.queue.Pop()
+			if !ok {
+				break
 			}
+			p.log.Info("receive request", "batch", req.Id, "level", req.Level, "files", req.Files)
+			p.handle(req)
 
-			// 4. tail of show
-			udpSender(TailStart)
-			time.Sleep(time.Duration(config.Gap) * time.Second)
-			if !isDataVary {
-				udpSender(TailEnd)
-				udpSender(WaitStart)
+		case c := <-p.chSyncReq:
+			// manual sync from admin api, no signal is sent
+			if err := p.sync(c); err != nil {
+				p.log.Error("fail to sync manually", "container", c, "error", err)
 			}
 
 		case <-done:
-			log.Println("done")
+			p.log.Info("handler done")
 			return
 		}
 	}
 }
 
+// handle uploads and syncs a batch.
+func (p *pipeline) handle(req Request) {
+	// 1. select contaienr, a resumed batch keeps its container
+	cont := p.jnl.Cont(req.Id)
+	if cont == "" {
+		cont = p.selectCont()
+		p.jnl.SetCont(req.Id, cont)
+	}
+	p.log.Info("select container", "batch", req.Id, "container", cont)
+	p.setBatch(req.Id, cont)
+	defer p.setBatch(0, "")
+	// dead files are retried out of the show, with no signal
+	show := p.show
+	if req.Dead {
+		// dead files failing again are queued after the next batch
+		defer atomic.AddInt32(&p.deadQueued, -1)
+		show = newShow(p.name, p.log, func(signalEvent) {})
+	}
+
+	// journaled before requests kept their samba directory
+	if req.Root == "" {
+		req.Root = p.getConf().Samba
+	}
+
+	// 2. upload files as a batch
+	b := Batch{Id: req.Id, Level: req.Level, Cont: cont, Files: req.Files}
+	show.StartUpload(b)
+	if req.Cool {
+		time.Sleep(time.Duration(p.getConf().Cool) * time.Second)
+	}
+	start := time.Now()
+	for _, r := range p.uploadFiles(req.Id, req.Root, req.Files, cont) {
+		if r.Err != nil {
+			p.log.Error("fail to upload file", "batch", req.Id, "file", r.File, "container", cont, "error", r.Err)
+			p.deadq.Add(req.Root, r.File, cont, r.Err)
+			metricFailed.Inc(p.name, cont)
+			b.Failed = append(b.Failed, r.File)
+			b.Err = r.Err
+		} else {
+			p.deadq.Remove(r.File)
+			b.Bytes += r.Size
+		}
+	}
+	b.Upload = time.Since(start)
+	time.Sleep(time.Duration(p.getConf().Gap) * time.Second)
+	if len(b.Failed) > 0 {
+		p.log.Error("fail to upload batch", "batch", req.Id, "failed", len(b.Failed), "total", len(req.Files))
+		b.Err = fmt.Errorf("%d of %d files failed, last error: %v", len(b.Failed), len(req.Files), b.Err)
+	}
+
+	// 3. sync
+	show.EndUpload(b)
+	upErr := b.Err
+	b.Err = nil
+	if p.jnl.Synced(req.Id) {
+		p.log.Info("skip synced container", "batch", req.Id, "container", cont)
+	} else {
+		start = time.Now()
+		b.Err = p.sync(cont)
+		b.Sync = time.Since(start)
+		if b.Err == nil {
+			p.jnl.Sync(req.Id)
+		}
+	}
+	show.EndSync(b)
+	p.jnl.Done(req.Id)
+	if b.Err != nil {
+		p.history.Result(cont, false, b.Err)
+	} else {
+		p.history.Result(cont, true, upErr)
+	}
+
+	// 4. tail of show, after the last batch queued
+	if req.Dead || p.queue.Batches() > 0 {
+		return
+	}
+	time.Sleep(time.Duration(p.getConf().Gap) * time.Second)
+	p.show.EndTail()
+}
+
+func isDone(done <-chan bool) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
 func main() {
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "run":
+		runCmd(args)
+	case "genconf":
+		genconfCmd(args)
+	case "validate":
+		validateCmd(args)
+	case "status":
+		statusCmd(args)
+	case "receive":
+		receiveCmd(args)
+	case "config":
+		configCmd(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func run() {
+	if addr := getConf().Admin; addr != "" {
+		go serveAPI(addr)
+	}
+	if addr := getConf().Metrics; addr != "" {
+		go serveMetrics(addr)
+	}
+
 	done := make(chan bool)
-	chReq := make(chan Request)
 
-	// start monitor: generate request, send to handler;
-	go monitor(done, chReq)
+	// reload configration on change
+	go watchConf(done)
+
+	var wg gosync.WaitGroup
+	for _, p := range pipelines {
+		p.start(done, &wg)
+	}
+
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-chSig
+	logger.Info("receive signal", "signal", sig)
+
+	// stop watching, let the current batch finish
+	close(done)
 
-	// start handler: handle request
-	go handler(done, chReq)
+	exit := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(exit)
+	}()
+
+	var timeout <-chan time.Time
+	if shutdown := getConf().Shutdown; shutdown > 0 {
+		timeout = time.After(time.Duration(shutdown) * time.Second)
+	}
 
-	<-done
+	select {
+	case <-exit:
+		var drain gosync.WaitGroup
+		for _, p := range pipelines {
+			drain.Add(1)
+			go func(p *pipeline) {
+				defer drain.Done()
+				p.signals.Drain(drainTimeout)
+			}(p)
+		}
+		drain.Wait()
+		logger.Info("exit")
+		os.Exit(0)
+	case <-timeout:
+		logger.Error("shutdown timeout")
+		os.Exit(1)
+	case sig = <-chSig:
+		logger.Error("receive signal again", "signal", sig)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// metric is exposed in prometheus text format.
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+// counterVec is a counter partitioned by label values.
+type counterVec struct {
+	mu     gosync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // key: label values joined by \xff
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	register(c)
+	return c
+}
+
+func (c *counterVec) Add(v float64, lvs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[strings.Join(lvs, "\xff")] += v
+}
+
+func (c *counterVec) Inc(lvs ...string) {
+	c.Add(1, lvs...)
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", c.name, labelPairs(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by label values.
+type histogramVec struct {
+	mu      gosync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, lvs ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(lvs, "\xff")
+	o, ok := h.values[key]
+	if !ok {
+		o = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = o
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			o.counts[i]++
+			break
+		}
+	}
+	o.count++
+	o.sum += v
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o := h.values[key]
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += o.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, "le", formatFloat(b)), cum)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, "le", "+Inf"), o.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, labelPairs(h.labels, key, "", ""), formatFloat(o.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, labelPairs(h.labels, key, "", ""), o.count)
+	}
+}
+
+// gaugeVec is a value which can go up and down, partitioned by
+// label values.
+type gaugeVec struct {
+	mu     gosync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // key: label values joined by \xff
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	register(g)
+	return g
+}
+
+func (g *gaugeVec) Set(v int, lvs ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[strings.Join(lvs, "\xff")] = float64(v)
+}
+
+func (g *gaugeVec) write(buf *bytes.Buffer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", g.name, labelPairs(g.labels, key, "", ""), formatFloat(g.values[key]))
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs formats {name="value",...}, with an extra pair if extra is not empty.
+func labelPairs(names []string, key string, extra, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+			}
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra+"="+strconv.Quote(extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var metrics []metric
+
+func register(m metric) {
+	metrics = append(metrics, m)
+}
+
+// buckets of duration in seconds
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+
+var (
+	metricEvents = newCounterVec("demo_fsnotify_events_total",
+		"File system events received, by pipeline and operation.", "pipeline", "op")
+	metricBatches = newCounterVec("demo_batches_total",
+		"Batches of files emitted by monitor, by pipeline.", "pipeline")
+	metricUploaded = newCounterVec("demo_files_uploaded_total",
+		"Files uploaded, by pipeline and container.", "pipeline", "container")
+	metricFailed = newCounterVec("demo_files_failed_total",
+		"Files failed to upload after all retries, by pipeline and container.", "pipeline", "container")
+	metricBytes = newCounterVec("demo_upload_bytes_total",
+		"Bytes uploaded, by pipeline and container.", "pipeline", "container")
+	metricUploadTime = newHistogramVec("demo_upload_duration_seconds",
+		"Duration of uploading a file, by pipeline and container.", durationBuckets, "pipeline", "container")
+	metricSyncTime = newHistogramVec("demo_sync_duration_seconds",
+		"Duration of syncing a container, by pipeline and container.", durationBuckets, "pipeline", "container")
+	metricSignals = newCounterVec("demo_signals_sent_total",
+		"Signals sent, by pipeline, target and code.", "pipeline", "target", "code")
+	metricSignalFailed = newCounterVec("demo_signals_failed_total",
+		"Signals failed to send or dropped, by pipeline and target.", "pipeline", "target")
+	metricPending = newGaugeVec("demo_pending_files",
+		"Files waiting in monitor to be emitted as a batch, by pipeline.", "pipeline")
+)
+
+var fsnotifyOps = []fsnotify.Op{
+	fsnotify.Create,
+	fsnotify.Write,
+	fsnotify.Remove,
+	fsnotify.Rename,
+	fsnotify.Chmod,
+}
+
+// observeEvent counts each operation of an event of pipeline.
+func observeEvent(pipeline string, op fsnotify.Op) {
+	for _, o := range fsnotifyOps {
+		if op&o == o {
+			metricEvents.Inc(pipeline, o.String())
+		}
+	}
+}
+
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// serveMetrics serves the metrics on addr.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		for _, m := range metrics {
+			m.write(&buf)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+
+	logger.Info("metrics listen", "addr", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		logger.Error("metrics error", "addr", addr, "error", err)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	gosync "sync"
+	"time"
+)
+
+// protocol of a signal target
+const (
+	TargetUdp      string = "udp"      // raw code in a datagram
+	TargetReliable string = "reliable" // acknowledged datagram, see signal.go
+	TargetGob      string = "gob"      // gob encoded code over tcp
+	TargetNdjson   string = "ndjson"   // newline delimited json over tcp
+	TargetHttp     string = "http"     // json posted to a webhook
+)
+
+const (
+	defaultTargetQueue = 64              // signals queued per target
+	targetTimeout      = 5 * time.Second // dial, write or http request
+	drainTimeout       = 5 * time.Second // delivery of queued signals on exit
+)
+
+// Target is a subscriber of signals.
+type Target struct {
+	Name  string   `json:"name"`
+	Proto string   `json:"proto"`           // udp, reliable, gob, ndjson or http
+	Addr  string   `json:"addr"`            // host:port, or url of http
+	Codes []string `json:"codes,omitempty"` // codes to send, empty for all
+	Queue int      `json:"queue,omitempty"` // signals queued, 0 for default
+
+	// http only
+	Headers map[string]string `json:"headers,omitempty"` // extra request headers
+	Secret  string            `json:"secret,omitempty"`  // key of hmac-sha256 signature
+	Retry   int               `json:"retry,omitempty"`   // retries of a failed post
+}
+
+func (t Target) wants(code string) bool {
+	if len(t.Codes) == 0 {
+		return true
+	}
+	for _, c := range t.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// signalTargets returns the targets of conf, the legacy udp and tcp
+// addresses are used if no target is configured.
+func signalTargets(conf Config) []Target {
+	if len(conf.Targets) > 0 {
+		return conf.Targets
+	}
+
+	var targets []Target
+	if conf.Udp != "" {
+		proto := TargetUdp
+		if conf.Protocol == ProtoReliable {
+			proto = TargetReliable
+		}
+		targets = append(targets, Target{Name: "udp", Proto: proto, Addr: conf.Udp})
+	}
+	if conf.Tcp != "" {
+		// the legacy tcp controller gets codes in gob
+		targets = append(targets, Target{Name: "tcp", Proto: TargetGob, Addr: conf.Tcp})
+	}
+	return targets
+}
+
+// signalEvent is a signal sent to targets, with the detail of the
+// batch being handled. Raw and gob targets get the code only.
+type signalEvent struct {
+	Code     string    `json:"code"`
+	Msg      string    `json:"msg"`
+	Time     time.Time `json:"time"`
+	Pipeline string    `json:"pipeline,omitempty"`
+	Batch    int       `json:"batch,omitempty"`
+	Level    int       `json:"level,omitempty"`
+	Cont     string    `json:"container,omitempty"`
+	Files    []string  `json:"files,omitempty"`
+	Failed   []string  `json:"failed,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Upload   float64   `json:"upload_seconds,omitempty"`
+	Sync     float64   `json:"sync_seconds,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type signalSender interface {
+	Send(ev signalEvent) error
+	Close() error
+}
+
+func newSignalSender(t Target, log *Logger, conf func() Config) (signalSender, error) {
+	switch t.Proto {
+	case TargetUdp:
+		return &udpSender{addr: t.Addr}, nil
+	case TargetReliable:
+		return &reliableSender{addr: t.Addr, log: log, conf: conf}, nil
+	case TargetGob:
+		// the code only, as old controllers expect
+		return &streamSender{addr: t.Addr, codeOnly: true,
+			newEnc: func(w io.Writer) encoder { return gob.NewEncoder(w) }}, nil
+	case TargetNdjson:
+		return &streamSender{addr: t.Addr,
+			newEnc: func(w io.Writer) encoder { return json.NewEncoder(w) }}, nil
+	case TargetHttp:
+		return &httpSender{target: t, log: log, client: &http.Client{Timeout: targetTimeout}}, nil
+	}
+	return nil, fmt.Errorf("unknown protocol: %s", t.Proto)
+}
+
+type udpSender struct {
+	addr string
+}
+
+func (s *udpSender) Send(ev signalEvent) error {
+	return sendRaw(s.addr, ev.Code)
+}
+
+func (s *udpSender) Close() error { return nil }
+
+type reliableSender struct {
+	addr string
+	log  *Logger
+	conf func() Config // ack timeout and retransmissions
+}
+
+func (s *reliableSender) Send(ev signalEvent) error {
+	conf := s.conf()
+	timeout := time.Duration(conf.AckTimeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = DefaultAckTimeout * time.Millisecond
+	}
+	return sendReliable(s.addr, ev.Code, timeout, conf.Retransmit, s.log)
+}
+
+func (s *reliableSender) Close() error { return nil }
+
+type encoder interface {
+	Encode(v interface{}) error
+}
+
+// streamSender keeps a tcp connection to the target, and redials
+// when the connection is broken.
+type streamSender struct {
+	addr     string
+	codeOnly bool // encode the code instead of the event
+	newEnc   func(w io.Writer) encoder
+	conn     net.Conn
+	enc      encoder
+}
+
+func (s *streamSender) Send(ev signalEvent) error {
+	// the connection may be closed by peer since last signal,
+	// which is known on write only, so try again on a new one
+	var err error
+	for i := 0; i < 2; i++ {
+		if s.conn == nil {
+			s.conn, err = net.DialTimeout("tcp", s.addr, targetTimeout)
+			if err != nil {
+				return err
+			}
+			s.enc = s.newEnc(s.conn)
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(targetTimeout))
+		if s.codeOnly {
+			err = s.enc.Encode(ev.Code)
+		} else {
+			err = s.enc.Encode(ev)
+		}
+		if err == nil {
+			return nil
+		}
+		s.Close()
+	}
+	return err
+}
+
+func (s *streamSender) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.enc = nil, nil
+	return err
+}
+
+// httpSender posts events to a webhook. The body is signed with
+// hmac-sha256 of the secret in header X-Demo-Signature, as
+// "sha256=<hex>", if a secret is configured.
+type httpSender struct {
+	target Target
+	log    *Logger
+	client *http.Client
+}
+
+func (s *httpSender) Send(ev signalEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for i := 0; ; i++ {
+		var retry bool
+		retry, err = s.post(ev, b)
+		if err == nil || !retry || i >= s.target.Retry {
+			return err
+		}
+
+		s.log.Warn("retry webhook", "target", s.target.Name, "code", ev.Code, "attempt", i+1, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// post posts body once, and reports whether a failure is worth retrying.
+func (s *httpSender) post(ev signalEvent, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", s.target.Addr, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range s.target.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Demo-Event", ev.Code)
+	if s.target.Secret != "" {
+		req.Header.Set("X-Demo-Signature", sign(s.target.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// client errors are not fixed by retry, except too many requests
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s: %s", s.target.Addr, resp.Status)
+	}
+	return false, nil
+}
+
+func (s *httpSender) Close() error { return nil }
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookHandler receives events posted by httpSender, and checks the
+// signature if secret is not empty. It stands in for a webhook in tests.
+func webhookHandler(secret string, f func(ev signalEvent)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if secret != "" && !hmac.Equal([]byte(r.Header.Get("X-Demo-Signature")), []byte(sign(secret, body))) {
+			logger.Warn("invalid webhook signature", "from", r.RemoteAddr)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var ev signalEvent
+		err = json.Unmarshal(body, &ev)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f(ev)
+	}
+}
+
+// targetWorker sends signals to a target in order. Each target has
+// its own worker, so a dead target does not block the others.
+type targetWorker struct {
+	target Target
+	ch     chan signalEvent
+	done   chan bool
+}
+
+func (n *notifier) startWorker(t Target) (*targetWorker, error) {
+	sender, err := newSignalSender(t, n.log, n.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	size := t.Queue
+	if size <= 0 {
+		size = defaultTargetQueue
+	}
+	w := &targetWorker{
+		target: t,
+		ch:     make(chan signalEvent, size),
+		done:   make(chan bool),
+	}
+
+	go func() {
+		defer close(w.done)
+		defer sender.Close()
+
+		var fails int
+		for ev := range w.ch {
+			err := sender.Send(ev)
+			if err != nil {
+				fails++
+				metricSignalFailed.Inc(n.pipeline, t.Name)
+				n.log.Error("send signal error", "target", t.Name, "code", ev.Code, "fails", fails, "error", err)
+				continue
+			}
+
+			if fails > 0 {
+				n.log.Info("signal target recovered", "target", t.Name, "fails", fails)
+				fails = 0
+			}
+			metricSignals.Inc(n.pipeline, t.Name, ev.Code)
+		}
+	}()
+	return w, nil
+}
+
+// notifier dispatches signals of a pipeline to the workers of targets.
+type notifier struct {
+	mu       gosync.Mutex
+	workers  []*targetWorker
+	pipeline string // name of pipeline, label of metrics
+	log      *Logger
+	conf     func() Config
+}
+
+func newNotifier(pipeline string, log *Logger, conf func() Config) *notifier {
+	return &notifier{pipeline: pipeline, log: log, conf: conf}
+}
+
+// Update starts workers of new or changed targets, and stops workers
+// of targets removed. Signals queued to a stopped worker are still sent.
+func (n *notifier) Update(targets []Target) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	old := make(map[string]*targetWorker)
+	for _, w := range n.workers {
+		old[w.target.Name] = w
+	}
+
+	var workers []*targetWorker
+	for _, t := range targets {
+		if w, ok := old[t.Name]; ok && reflect.DeepEqual(w.target, t) {
+			delete(old, t.Name)
+			workers = append(workers, w)
+			continue
+		}
+
+		w, err := n.startWorker(t)
+		if err != nil {
+			n.log.Error("fail to start signal target", "target", t.Name, "error", err)
+			continue
+		}
+		n.log.Info("signal target", "target", t.Name, "proto", t.Proto, "addr", t.Addr)
+		workers = append(workers, w)
+	}
+
+	for _, w := range old {
+		close(w.ch)
+	}
+	n.workers = workers
+}
+
+// Notify queues the signal to every target which wants it.
+func (n *notifier) Notify(ev signalEvent) {
+	code := ev.Code
+	n.log.Info("send signal", "code", code, "msg", ev.Msg, "batch", ev.Batch)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, w := range n.workers {
+		if !w.target.wants(code) {
+			continue
+		}
+
+		select {
+		case w.ch <- ev:
+		default:
+			metricSignalFailed.Inc(n.pipeline, w.target.Name)
+			n.log.Error("signal queue full, drop signal", "target", w.target.Name, "code", code)
+		}
+	}
+}
+
+// Drain stops the workers, and waits until the queued signals are
+// sent or timeout.
+func (n *notifier) Drain(timeout time.Duration) {
+	n.mu.Lock()
+	workers := n.workers
+	n.workers = nil
+	n.mu.Unlock()
+
+	for _, w := range workers {
+		close(w.ch)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-timer.C:
+			n.log.Warn("signals not sent on exit", "target", w.target.Name, "queued", len(w.ch))
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	gosync "sync"
+	"testing"
+)
+
+// hookServer runs webhookHandler, recording the events received.
+type hookServer struct {
+	mu      gosync.Mutex
+	events  []signalEvent
+	headers []http.Header
+	fail    int // requests failed with 503 before the handler
+}
+
+func newHookServer(t *testing.T, secret string) (*hookServer, string) {
+	h := &hookServer{}
+	hook := webhookHandler(secret, func(ev signalEvent) {
+		h.events = append(h.events, ev)
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.headers = append(h.headers, r.Header)
+		if h.fail > 0 {
+			h.fail--
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		hook(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return h, server.URL
+}
+
+func newTestHTTPSender(t *testing.T, target Target) signalSender {
+	log := &Logger{level: LevelError, format: FormatText, out: ioutil.Discard}
+	s, err := newSignalSender(target, log, func() Config { return Config{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWebhook(t *testing.T) {
+	h, url := newHookServer(t, "123456")
+	s := newTestHTTPSender(t, Target{Name: "hook", Proto: TargetHttp, Addr: url, Secret: "123456",
+		Headers: map[string]string{"Authorization": "Bearer token"}})
+
+	ev := signalEvent{
+		Code:   UploadErr,
+		Msg:    msgInfo[UploadErr],
+		Batch:  3,
+		Cont:   "hello",
+		Files:  []string{"a.mp4", "b.mp4"},
+		Failed: []string{"b.mp4"},
+		Bytes:  1024,
+		Error:  "1 of 2 files failed",
+	}
+	if err := s.Send(ev); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if len(h.events) != 1 {
+		t.Fatalf("received %d events, want 1", len(h.events))
+	}
+	got := h.events[0]
+	if got.Code != ev.Code || got.Batch != ev.Batch || got.Cont != ev.Cont || got.Error != ev.Error ||
+		len(got.Files) != 2 || len(got.Failed) != 1 || got.Bytes != ev.Bytes {
+		t.Errorf("received %+v, want %+v", got, ev)
+	}
+	if a := h.headers[0].Get("Authorization"); a != "Bearer token" {
+		t.Errorf("Authorization = %q", a)
+	}
+	if c := h.headers[0].Get("X-Demo-Event"); c != UploadErr {
+		t.Errorf("X-Demo-Event = %q, want %q", c, UploadErr)
+	}
+}
+
+func TestWebhookBadSignature(t *testing.T) {
+	h, url := newHookServer(t, "123456")
+	s := newTestHTTPSender(t, Target{Name: "hook", Proto: TargetHttp, Addr: url, Secret: "wrong", Retry: 2})
+
+	// a client error is not retried
+	if err := s.Send(signalEvent{Code: SyncDone}); err == nil {
+		t.Fatal("Send with wrong secret succeeded")
+	}
+	if len(h.events) != 0 || len(h.headers) != 1 {
+		t.Errorf("received %d events in %d requests, want 0 in 1", len(h.events), len(h.headers))
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	h, url := newHookServer(t, "")
+	h.fail = 1
+	s := newTestHTTPSender(t, Target{Name: "hook", Proto: TargetHttp, Addr: url, Retry: 1})
+
+	if err := s.Send(signalEvent{Code: SyncDone}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(h.events) != 1 || len(h.headers) != 2 {
+		t.Errorf("received %d events in %d requests, want 1 in 2", len(h.events), len(h.headers))
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"code":"13"}`)
+	if sign("a", body) == sign("b", body) {
+		t.Error("signatures of different secrets are equal")
+	}
+	if sig := sign("a", body); !strings.HasPrefix(sig, "sha256=") {
+		t.Errorf("signature %q, want sha256=<hex>", sig)
+	}
+}
+
+func TestSignalTargetsLegacy(t *testing.T) {
+	got := signalTargets(Config{Udp: "localhost:1234", Tcp: "localhost:1235", Protocol: ProtoReliable})
+	want := []Target{
+		{Name: "udp", Proto: TargetReliable, Addr: "localhost:1234"},
+		{Name: "tcp", Proto: TargetGob, Addr: "localhost:1235"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("signalTargets = %+v, want %+v", got, want)
+	}
+
+	// configured targets replace the legacy addresses
+	targets := []Target{{Name: "hook", Proto: TargetHttp, Addr: "http://localhost/"}}
+	got = signalTargets(Config{Udp: "localhost:1234", Tcp: "localhost:1235", Targets: targets})
+	if !reflect.DeepEqual(got, targets) {
+		t.Errorf("signalTargets = %+v, want %+v", got, targets)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	gosync "sync"
+	"sync/atomic"
+)
+
+// PipelineConfig is a pipeline in Config.Pipelines, a table of Config
+// fields overriding the top level, e.g.
+//
+//	{"name": "studio1", "samba": "/mnt/studio1", "tenant": "s1", "gap": 5}
+//
+// Fields of the process can't be overridden, see processFields.
+type PipelineConfig map[string]interface{}
+
+// fields of the process, not allowed in a pipeline
+var processFields = []string{"admin", "metrics", "shutdown", "pipelines"}
+
+// fields of password, a pipeline giving any of them overrides all
+var passFields = []string{"pass", "pass_env", "pass_file", "pass_cmd"}
+
+// the name of the only pipeline if none is configured
+const DefaultPipeline string = "default"
+
+// pipelineConfs returns the configuration of each pipeline. Without
+// Config.Pipelines, the top level is the only pipeline.
+func pipelineConfs(conf Config) ([]Config, error) {
+	if len(conf.Pipelines) == 0 {
+		return []Config{conf}, nil
+	}
+
+	var confs []Config
+	for i, pc := range conf.Pipelines {
+		c, err := pipelineConf(conf, pc)
+		if err != nil {
+			return nil, fmt.Errorf("pipelines[%d]: %v", i, err)
+		}
+		confs = append(confs, c)
+	}
+	return confs, nil
+}
+
+// pipelineConf layers the fields of pc over the top level conf. The
+// pipeline keeps its state in a subdirectory named after it, unless
+// given a state directory.
+func pipelineConf(conf Config, pc PipelineConfig) (Config, error) {
+	conf.Name = ""
+	conf.Pipelines = nil
+	if hasField(pc, passFields...) {
+		conf.Pass, conf.PassEnv, conf.PassFile, conf.PassCmd = "", "", "", nil
+		conf.passErr = nil
+	}
+
+	source := fmt.Sprintf("pipeline %v", pc["name"])
+	err := layerTree(reflect.ValueOf(&conf).Elem(), pc, "", source, make(confSource))
+	if err != nil {
+		return Config{}, err
+	}
+	cleanPaths(&conf)
+
+	if !hasField(pc, "state") {
+		conf.StateDir = filepath.Join(stateDir(conf), conf.Name)
+	}
+	if hasField(pc, passFields...) {
+		conf.Pass, conf.passErr = resolvePass(conf)
+	}
+	logger.Redact(secretsOf(conf)...)
+	return conf, nil
+}
+
+func hasField(pc PipelineConfig, fields ...string) bool {
+	for _, f := range fields {
+		if _, ok := pc[f]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// uploaderBox keeps the concrete type stored in pipeline.uploader the same.
+type uploaderBox struct {
+	Uploader
+}
+
+// pipeline watches a samba directory and uploads its files. Pipelines
+// are isolated from each other: configuration, state, signal targets,
+// logs and status are their own.
+type pipeline struct {
+	name     string
+	conf     atomic.Value // Config, swapped as a whole on reload
+	uploader atomic.Value // uploaderBox
+	filter   atomic.Value // *fileFilter
+	priority atomic.Value // *priority
+	log      *Logger
+	root     string // samba directory watched, used by monitor only
+
+	show       *Show
+	queue      *reqQueue
+	signals    *notifier
+	history    *contHistory
+	jnl        *journal
+	deadq      *deadLetter
+	deadQueued int32 // requests of dead files queued
+
+	// status and controls of admin api
+	mu        gosync.Mutex
+	cont      string // last selected container
+	batch     int    // id of the batch being handled
+	pending   int    // files waiting in monitor
+	paused    int32  // monitor emits no batch while paused
+	chFlush   chan bool
+	chSyncReq chan string
+	chSamba   chan bool // samba directory changed on reload
+}
+
+// the pipelines running, in the order of configuration
+var pipelines []*pipeline
+
+// newPipeline creates a pipeline of validated conf, and loads its state.
+func newPipeline(conf Config) (*pipeline, error) {
+	p := &pipeline{
+		name:      conf.Name,
+		log:       logger,
+		queue:     newReqQueue(),
+		chFlush:   make(chan bool, 1),
+		chSyncReq: make(chan string, 8),
+		chSamba:   make(chan bool, 1),
+	}
+	if p.name == "" {
+		p.name = DefaultPipeline
+	} else {
+		p.log = logger.With("pipeline", p.name)
+		err := p.log.Configure(conf.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	up, err := newUploader(conf)
+	if err != nil {
+		return nil, err
+	}
+	p.setConf(conf, up)
+
+	p.signals = newNotifier(p.name, p.log, p.getConf)
+	p.signals.Update(signalTargets(conf))
+	p.show = newShow(conf.Name, p.log, p.signals.Notify)
+
+	dir := stateDir(conf)
+	p.deadq, err = loadDeadLetter(dir, p.log)
+	if err != nil {
+		p.log.Error("fail to load dead letter", "error", err)
+	}
+
+	p.history, err = loadHistory(dir, p.log)
+	if err != nil {
+		p.log.Error("fail to load container history", "error", err)
+	}
+
+	p.jnl, err = openJournal(dir, p.log)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open journal: %v", err)
+	}
+	return p, nil
+}
+
+func findPipeline(name string) *pipeline {
+	for _, p := range pipelines {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *pipeline) getConf() Config {
+	conf, _ := p.conf.Load().(Config)
+	return conf
+}
+
+func (p *pipeline) getUploader() Uploader {
+	box, _ := p.uploader.Load().(uploaderBox)
+	return box.Uploader
+}
+
+func (p *pipeline) getFilter() *fileFilter {
+	f, _ := p.filter.Load().(*fileFilter)
+	if f == nil {
+		return &fileFilter{log: p.log}
+	}
+	return f
+}
+
+func (p *pipeline) getPriority() *priority {
+	pr, _ := p.priority.Load().(*priority)
+	if pr == nil {
+		return &priority{}
+	}
+	return pr
+}
+
+// setConf swaps in conf, which must be validated.
+func (p *pipeline) setConf(conf Config, up Uploader) {
+	filter, err := newFilter(conf.Filter, p.log)
+	if err != nil {
+		p.log.Error("invalid filter", "error", err)
+		filter = &fileFilter{log: p.log}
+	}
+	pr, err := newPriority(conf.Priority)
+	if err != nil {
+		p.log.Error("invalid priority", "error", err)
+		pr = &priority{}
+	}
+
+	p.uploader.Store(uploaderBox{up})
+	p.filter.Store(filter)
+	p.priority.Store(pr)
+	p.conf.Store(conf)
+}
+
+// reload swaps in conf of the pipeline, which is validated.
+func (p *pipeline) reload(conf Config) {
+	old := p.getConf()
+	if reflect.DeepEqual(conf, old) {
+		return
+	}
+
+	up, err := newUploader(conf)
+	if err != nil {
+		p.log.Error("reload error", "error", err)
+		return
+	}
+
+	if p.log != logger {
+		err = p.log.Configure(conf.Log)
+		if err != nil {
+			p.log.Error("reload error", "error", err)
+			return
+		}
+	}
+
+	p.setConf(conf, up)
+	p.signals.Update(signalTargets(conf))
+	p.log.Info("reload pipeline", "config", conf)
+
+	if conf.StateDir != old.StateDir {
+		p.log.Warn("state directory takes effect after restart", "dir", conf.StateDir)
+	}
+	if conf.Watcher != old.Watcher || conf.Poll != old.Poll {
+		p.log.Warn("watcher takes effect after restart", "watcher", conf.Watcher)
+	}
+
+	if conf.Samba != old.Samba {
+		select {
+		case p.chSamba <- true:
+		default:
+			// monitor has not handled last change yet
+		}
+	}
+}
+
+// start runs the monitor and handler of p until done.
+func (p *pipeline) start(done <-chan bool, wg *gosync.WaitGroup) {
+	wg.Add(2)
+
+	// start monitor: generate request, queue it for handler;
+	go func() {
+		defer wg.Done()
+		p.monitor(done)
+	}()
+
+	// start handler: handle request by priority
+	go func() {
+		defer wg.Done()
+		p.handler(done)
+	}()
+}
+
+func (p *pipeline) isPaused() bool {
+	return atomic.LoadInt32(&p.paused) == 1
+}
+
+func (p *pipeline) setBatch(id int, cont string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.batch = id
+	if cont != "" {
+		p.cont = cont
+	}
+}
+
+func (p *pipeline) setPending(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending = n
+}
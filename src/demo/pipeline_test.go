@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestPipeline returns a pipeline uploading to a fake DAM, with
+// no delays and its state in a temporary directory.
+func newTestPipeline(t *testing.T, samba string) (*pipeline, *fakeDam) {
+	dam := newFakeDam()
+	server := httptest.NewServer(dam)
+	t.Cleanup(server.Close)
+
+	saved := logger
+	logger = &Logger{level: LevelError, format: FormatText, out: ioutil.Discard}
+	t.Cleanup(func() { logger = saved })
+
+	conf := defaultConf()
+	conf.Backend = BackendDam
+	conf.Dam = server.URL
+	conf.Tenant = "da"
+	conf.User = "system"
+	conf.Pass = "secret"
+	conf.Conts = []string{"hello"}
+	conf.Samba = samba
+	conf.StateDir = t.TempDir()
+	conf.Udp = ""
+	conf.Cool, conf.Gap, conf.Backoff = 0, 0, 0
+
+	p, err := newPipeline(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.jnl.file.Close() })
+	return p, dam
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A request queued before samba changes is uploaded from its own directory.
+func TestReloadSambaQueued(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, newDir := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	writeFile(t, oldDir, "a.mp4", "old")
+	writeFile(t, newDir, "a.mp4", "new")
+
+	p, dam := newTestPipeline(t, oldDir)
+	req := Request{Root: oldDir, Files: []string{"a.mp4"}}
+	req.Id = p.jnl.Push(req)
+	p.queue.Push(req, 0)
+
+	conf := p.getConf()
+	conf.Samba = newDir
+	p.reload(conf)
+
+	if reqs := p.jnl.Open(); len(reqs) != 1 || reqs[0].Root != oldDir {
+		t.Fatalf("journal requests = %+v, want one of %s", reqs, oldDir)
+	}
+	req, _ = p.queue.Pop()
+	p.handle(req)
+
+	if got := string(dam.objects["hello/a.mp4"]); got != "old" {
+		t.Errorf("object = %q, want %q", got, "old")
+	}
+}
+
+// The batches of a cutoff make one show, its tail ends after the last
+// batch, and dead files are retried without signals.
+func TestHandleShow(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.mp4", "a")
+	writeFile(t, dir, "b.txt", "b")
+
+	p, _ := newTestPipeline(t, dir)
+	var codes []string
+	p.show = newShow("", p.log, func(ev signalEvent) { codes = append(codes, ev.Code) })
+
+	p.show.BatchReady()
+	for i, req := range []Request{{Level: 1, Files: []string{"a.mp4"}}, {Files: []string{"b.txt"}}} {
+		req.Root, req.Cool = dir, i == 0
+		req.Id = p.jnl.Push(req)
+		p.queue.Push(req, 0)
+	}
+	dead := Request{Root: dir, Files: []string{"b.txt"}, Dead: true}
+	dead.Id = p.jnl.Push(dead)
+	p.queue.Push(dead, 0)
+
+	for {
+		req, ok := p.queue.Pop()
+		if !ok {
+			break
+		}
+		p.handle(req)
+	}
+
+	batch := []string{UploadStart, UploadDone, SyncStart, SyncDone, TailStart}
+	want := append([]string{StreamDone}, batch...)
+	want = append(want, batch...)
+	want = append(want, TailEnd, WaitStart)
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("codes = %v, want %v", codes, want)
+	}
+}
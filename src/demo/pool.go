@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	gosync "sync"
+)
+
+// uploadResult is the result of uploading a file of a batch.
+type uploadResult struct {
+	File string
+	Size int64 // size of file uploaded
+	Err  error
+}
+
+// uploadFiles uploads the files of batch id in samba directory root
+// to cont with at most Config.Workers files in flight, and returns
+// when all are finished.
+func (p *pipeline) uploadFiles(id int, root string, files []string, cont string) []uploadResult {
+	workers := p.getConf().Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	chFile := make(chan string)
+	chResult := make(chan uploadResult)
+
+	var wg gosync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range chFile {
+				if p.jnl.Uploaded(id, file) {
+					p.log.Info("skip uploaded file", "batch", id, "file", file)
+					chResult <- uploadResult{File: file, Size: p.fileSize(root, file)}
+					continue
+				}
+
+				err := p.uploadRetry(root, file, cont)
+				if err != nil {
+					chResult <- uploadResult{File: file, Err: err}
+					continue
+				}
+				p.jnl.Upload(id, file)
+				chResult <- uploadResult{File: file, Size: p.fileSize(root, file)}
+			}
+		}()
+	}
+
+	go func() {
+		for _, file := range files {
+			chFile <- file
+		}
+		close(chFile)
+		wg.Wait()
+		close(chResult)
+	}()
+
+	var results []uploadResult
+	for r := range chResult {
+		results = append(results, r)
+	}
+	return results
+}
+
+// fileSize returns the size of file in samba directory root, 0 if unknown.
+func (p *pipeline) fileSize(root, file string) int64 {
+	info, err := os.Stat(filepath.Join(root, filepath.FromSlash(file)))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
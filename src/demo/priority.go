@@ -0,0 +1,240 @@
+package main
+
+import (
+	"container/heap"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// the seconds a waiting batch takes to gain a level by default
+const DefaultAging int = 60
+
+// PriorityConfig assigns a level to each file, and a batch holds the
+// files of one level. The first matching rule gives the level, 0 if
+// none matches.
+//
+// Batches of higher levels are handled first. A waiting batch gains a
+// level every Aging seconds, so bulk batches are delayed, not starved:
+// a batch of level L is handled as if it were queued L*Aging seconds
+// earlier.
+type PriorityConfig struct {
+	Rules []PriorityRule `json:"rules,omitempty"`
+	Aging int            `json:"aging"` // seconds a waiting batch takes to gain a level
+}
+
+// PriorityRule matches a file if every condition given matches, and
+// a list of conditions matches if any of them does. Globs and
+// extensions match as in FilterConfig.
+type PriorityRule struct {
+	Level   int      `json:"level"`
+	Glob    []string `json:"glob,omitempty"`
+	Regex   []string `json:"regex,omitempty"`    // of the relative path
+	Ext     []string `json:"ext,omitempty"`      // e.g. ".mp4"
+	MinSize int64    `json:"min_size,omitempty"` // bytes
+	MaxSize int64    `json:"max_size,omitempty"` // bytes, 0 for no limit
+}
+
+// priority is PriorityConfig with compiled regexes.
+type priority struct {
+	rules []PriorityRule
+	res   [][]*regexp.Regexp // regexes of each rule
+}
+
+func newPriority(conf PriorityConfig) (*priority, error) {
+	p := &priority{rules: conf.Rules}
+	for _, r := range conf.Rules {
+		var res []*regexp.Regexp
+		for _, s := range r.Regex {
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, re)
+		}
+		p.res = append(p.res, res)
+	}
+	return p, nil
+}
+
+// Level returns the level of file, relative to samba directory.
+func (p *priority) Level(file string, size int64) int {
+	for i, r := range p.rules {
+		if r.match(file, size, p.res[i]) {
+			return r.Level
+		}
+	}
+	return 0
+}
+
+func (r PriorityRule) match(file string, size int64, res []*regexp.Regexp) bool {
+	if len(r.Glob) > 0 {
+		var ok bool
+		for _, g := range r.Glob {
+			if matchGlob(g, file) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(res) > 0 {
+		var ok bool
+		for _, re := range res {
+			if re.MatchString(file) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.Ext) > 0 {
+		ext := path.Ext(file)
+		var ok bool
+		for _, e := range r.Ext {
+			if strings.EqualFold(e, ext) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if size < r.MinSize {
+		return false
+	}
+	return r.MaxSize == 0 || size <= r.MaxSize
+}
+
+// queued is a request waiting in reqQueue.
+type queued struct {
+	req Request
+	due time.Time // the queued time, moved earlier by level
+}
+
+type reqHeap []queued
+
+func (h reqHeap) Len() int { return len(h) }
+
+func (h reqHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].req.Id < h[j].req.Id
+	}
+	return h[i].due.Before(h[j].due)
+}
+
+func (h reqHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *reqHeap) Push(x interface{}) { *h = append(*h, x.(queued)) }
+
+func (h *reqHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// reqQueue is the priority queue of requests between monitor and
+// handler. Monitor never waits for handler, a request is journaled
+// before it is queued.
+type reqQueue struct {
+	mu    gosync.Mutex
+	items reqHeap
+	ready chan bool // a request is waiting
+}
+
+func newReqQueue() *reqQueue {
+	return &reqQueue{ready: make(chan bool, 1)}
+}
+
+// Push queues req, aging is seconds a waiting request takes to gain
+// a level.
+func (q *reqQueue) Push(req Request, aging int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	due := time.Now().Add(-time.Duration(req.Level*aging) * time.Second)
+	heap.Push(&q.items, queued{req: req, due: due})
+	q.notify()
+}
+
+// Pop returns the most urgent request, false if none is waiting.
+func (q *reqQueue) Pop() (Request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return Request{}, false
+	}
+	x := heap.Pop(&q.items).(queued)
+	if len(q.items) > 0 {
+		q.notify()
+	}
+	return x.req, true
+}
+
+func (q *reqQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+// Batches returns the requests waiting, not counting the retries of
+// dead files.
+func (q *reqQueue) Batches() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var n int
+	for _, x := range q.items {
+		if !x.req.Dead {
+			n++
+		}
+	}
+	return n
+}
+
+// Ready is signaled when a request is waiting.
+func (q *reqQueue) Ready() <-chan bool {
+	return q.ready
+}
+
+func (q *reqQueue) notify() {
+	select {
+	case q.ready <- true:
+	default:
+		// handler has not been woken up yet
+	}
+}
+
+// splitLevel splits files into requests by level, the most urgent first.
+func splitLevel(files []string, level func(file string) int) []Request {
+	byLevel := make(map[int][]string)
+	var levels []int
+	for _, f := range files {
+		l := level(f)
+		if _, ok := byLevel[l]; !ok {
+			levels = append(levels, l)
+		}
+		byLevel[l] = append(byLevel[l], f)
+	}
+
+	var reqs []Request
+	for _, l := range levels {
+		reqs = append(reqs, Request{Level: l, Files: byLevel[l]})
+	}
+	sort.Slice(reqs, func(a, b int) bool { return reqs[a].Level > reqs[b].Level })
+	return reqs
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func popIds(q *reqQueue) []int {
+	var ids []int
+	for {
+		req, ok := q.Pop()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, req.Id)
+	}
+}
+
+func TestReqQueueOrder(t *testing.T) {
+	q := newReqQueue()
+	q.Push(Request{Id: 1, Level: 0}, DefaultAging)
+	q.Push(Request{Id: 2, Level: 2}, DefaultAging)
+	q.Push(Request{Id: 3, Level: 1}, DefaultAging)
+	q.Push(Request{Id: 4, Level: 2}, DefaultAging)
+
+	if ids := popIds(q); !reflect.DeepEqual(ids, []int{2, 4, 3, 1}) {
+		t.Errorf("order = %v, want [2 4 3 1]", ids)
+	}
+}
+
+// A waiting batch gains a level every aging seconds, so a bulk batch
+// queued long enough ago goes before a newer urgent one.
+func TestReqQueueAging(t *testing.T) {
+	q := newReqQueue()
+	q.Push(Request{Id: 1, Level: 0}, 60)
+	q.items[0].due = q.items[0].due.Add(-121 * time.Second) // queued 121 seconds ago
+	q.Push(Request{Id: 2, Level: 2}, 60)
+	q.Push(Request{Id: 3, Level: 1}, 60)
+
+	if ids := popIds(q); !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Errorf("order = %v, want [1 2 3]", ids)
+	}
+
+	// no aging, the order of queuing
+	q.Push(Request{Id: 4, Level: 2}, 0)
+	q.Push(Request{Id: 5, Level: 0}, 0)
+	if ids := popIds(q); !reflect.DeepEqual(ids, []int{4, 5}) {
+		t.Errorf("order without aging = %v, want [4 5]", ids)
+	}
+}
+
+func TestReqQueueBatches(t *testing.T) {
+	q := newReqQueue()
+	q.Push(Request{Id: 1}, 0)
+	q.Push(Request{Id: 2, Dead: true}, 0)
+
+	if q.Len() != 2 || q.Batches() != 1 {
+		t.Errorf("len %d, batches %d, want 2 and 1", q.Len(), q.Batches())
+	}
+}
+
+func TestSplitLevel(t *testing.T) {
+	levels := map[string]int{"a.mp4": 1, "b.txt": 0, "c.mp4": 1, "d.wav": 2}
+	level := func(file string) int { return levels[file] }
+
+	for _, c := range []struct {
+		files []string
+		want  []Request
+	}{
+		{nil, nil},
+		{[]string{"b.txt"}, []Request{{Level: 0, Files: []string{"b.txt"}}}},
+		{[]string{"a.mp4", "b.txt", "c.mp4", "d.wav"}, []Request{
+			{Level: 2, Files: []string{"d.wav"}},
+			{Level: 1, Files: []string{"a.mp4", "c.mp4"}},
+			{Level: 0, Files: []string{"b.txt"}},
+		}},
+	} {
+		if got := splitLevel(c.files, level); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitLevel(%v) = %+v, want %+v", c.files, got, c.want)
+		}
+	}
+}
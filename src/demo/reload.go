@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// the configuration in use, swapped as a whole on reload; the
+// pipelines have their own, see pipeline.getConf
+var curConf atomic.Value // Config
+
+func getConf() Config {
+	conf, _ := curConf.Load().(Config)
+	return conf
+}
+
+// setConf swaps in conf, which must be validated.
+func setConf(conf Config) {
+	curConf.Store(conf)
+}
+
+// reload loads and validates the configuration file, and swaps it in
+// the process and every pipeline. Pipelines added or removed take
+// effect after restart.
+func reload() {
+	conf, err := loadConf()
+	if err != nil {
+		logger.Error("reload error", "error", err)
+		return
+	}
+
+	old := getConf()
+	if reflect.DeepEqual(conf, old) {
+		logger.Info("configration not changed")
+		return
+	}
+
+	err = validateConf(conf)
+	if err != nil {
+		logger.Error("reload error", "error", err)
+		return
+	}
+
+	confs, err := pipelineConfs(conf)
+	if err != nil {
+		logger.Error("reload error", "error", err)
+		return
+	}
+
+	err = logger.Configure(conf.Log)
+	if err != nil {
+		logger.Error("reload error", "error", err)
+		return
+	}
+
+	setConf(conf)
+	logger.Info("reload configration", "config", conf)
+
+	names := make(map[string]bool)
+	for _, c := range confs {
+		name := c.Name
+		if name == "" {
+			name = DefaultPipeline
+		}
+		p := findPipeline(name)
+		if p == nil {
+			logger.Warn("new pipeline takes effect after restart", "pipeline", c.Name)
+			continue
+		}
+		names[p.name] = true
+		p.reload(c)
+	}
+	for _, p := range pipelines {
+		if !names[p.name] {
+			logger.Warn("pipeline removed, runs until restart", "pipeline", p.name)
+		}
+	}
+}
+
+// watchConf reloads the configuration on SIGHUP or when the
+// configuration file is changed.
+func watchConf(done <-chan bool) {
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+
+	// no configuration file found, reloaded on SIGHUP only
+	if confPath != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			defer watcher.Close()
+
+			// watch the directory, editors often replace the file
+			err = watcher.Add(filepath.Dir(confPath))
+			events, errs = watcher.Events, watcher.Errors
+		}
+		if err != nil {
+			logger.Error("fail to watch config file", "file", confPath, "error", err)
+		}
+	}
+
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, syscall.SIGHUP)
+	defer signal.Stop(chSig)
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case event := <-events:
+			if filepath.Clean(event.Name) != confPath || event.Op == fsnotify.Chmod {
+				continue
+			}
+			// wait for writing to finish
+			delay = time.After(time.Second)
+
+		case err := <-errs:
+			if err != nil {
+				logger.Error("config watcher error", "error", err)
+			}
+
+		case sig := <-chSig:
+			logger.Info("receive signal", "signal", sig)
+			reload()
+
+		case <-delay:
+			delay = nil
+			logger.Info("config file changed", "file", confPath)
+			reload()
+
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// suffix layout of rotated log files
+const rotateLayout = "20060102-150405"
+
+// suffix of the file keeping when the log file was created, as
+// modification time changes on every write
+const startSuffix = ".start"
+
+// rotateWriter writes to a log file, which is rotated when it is
+// larger than MaxSize or older than Rotate. The rotated files beyond
+// Backups or older than MaxAge are removed.
+type rotateWriter struct {
+	mu      gosync.Mutex
+	conf    LogConfig
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+func newRotateWriter(conf LogConfig) (*rotateWriter, error) {
+	w := &rotateWriter{conf: conf}
+
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	err := os.MkdirAll(filepath.Dir(w.conf.File), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+	if w.size == 0 {
+		w.created = time.Now()
+		w.saveStart()
+	} else {
+		w.created = w.loadStart(info.ModTime())
+	}
+	return nil
+}
+
+func (w *rotateWriter) saveStart() {
+	err := ioutil.WriteFile(w.conf.File+startSuffix, []byte(w.created.Format(time.RFC3339)), 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "log rotate error:", err)
+	}
+}
+
+// loadStart returns when the log file was created, def if unknown.
+func (w *rotateWriter) loadStart(def time.Time) time.Time {
+	b, err := ioutil.ReadFile(w.conf.File + startSuffix)
+	if err != nil {
+		return def
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+	if err != nil {
+		return def
+	}
+	return t
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if w.needRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "log rotate error:", err)
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) needRotate(n int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.conf.MaxSize > 0 && w.size+n > int64(w.conf.MaxSize)*1024*1024 {
+		return true
+	}
+	if w.conf.Rotate > 0 && time.Since(w.created) > time.Duration(w.conf.Rotate)*time.Hour {
+		return true
+	}
+	return false
+}
+
+func (w *rotateWriter) rotate() error {
+	w.file.Close()
+	w.file = nil
+
+	name := rotatedName(w.conf.File, time.Now())
+	err := os.Rename(w.conf.File, name)
+	if err != nil {
+		// keep writing to the current file
+		fmt.Fprintln(os.Stderr, "log rotate error:", err)
+	}
+
+	err = w.open()
+	if err != nil {
+		return err
+	}
+
+	w.clean()
+	return nil
+}
+
+// clean removes the rotated files beyond retention.
+func (w *rotateWriter) clean() {
+	files, err := filepath.Glob(w.conf.File + ".*")
+	if err != nil {
+		return
+	}
+
+	type rotatedFile struct {
+		name string
+		time time.Time
+		seq  int
+	}
+	var rotated []rotatedFile
+	for _, file := range files {
+		t, seq, ok := parseRotated(strings.TrimPrefix(file, w.conf.File+"."))
+		if ok {
+			rotated = append(rotated, rotatedFile{file, t, seq})
+		}
+	}
+	// newest first
+	sort.Slice(rotated, func(a, b int) bool {
+		if rotated[a].time.Equal(rotated[b].time) {
+			return rotated[a].seq > rotated[b].seq
+		}
+		return rotated[a].time.After(rotated[b].time)
+	})
+
+	for i, f := range rotated {
+		remove := w.conf.Backups > 0 && i >= w.conf.Backups
+		if w.conf.MaxAge > 0 && time.Since(f.time) > time.Duration(w.conf.MaxAge)*24*time.Hour {
+			remove = true
+		}
+
+		if remove {
+			os.Remove(f.name)
+		}
+	}
+}
+
+// rotatedName returns the name of file rotated at t. Files rotated in
+// the same second get a sequence number, e.g. demo.log.20060102-150405.1
+func rotatedName(file string, t time.Time) string {
+	name := file + "." + t.Format(rotateLayout)
+	for seq := 1; ; seq++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%s.%d", file, t.Format(rotateLayout), seq)
+	}
+}
+
+// parseRotated parses the suffix of a rotated file, the time and the
+// sequence number in that second.
+func parseRotated(suffix string) (time.Time, int, bool) {
+	var seq int
+	if i := strings.IndexByte(suffix, '.'); i >= 0 {
+		n, err := strconv.Atoi(suffix[i+1:])
+		if err != nil || n <= 0 {
+			return time.Time{}, 0, false
+		}
+		suffix, seq = suffix[:i], n
+	}
+	t, err := time.ParseInLocation(rotateLayout, suffix, time.Local)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return t, seq, true
+}
+
+func (w *rotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
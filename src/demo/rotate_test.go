@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Rotations in the same second must not overwrite each other.
+func TestRotateSameSecond(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "demo.log")
+	w, err := newRotateWriter(LogConfig{File: file, MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	chunk := bytes.Repeat([]byte("x"), 700<<10)
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the log file and the rotated ones
+	files, _ := filepath.Glob(file + ".2*")
+	files = append(files, file)
+	var total int64
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	if len(files) != 3 || total != 3*int64(len(chunk)) {
+		t.Errorf("files %v hold %d bytes, want 3 files of %d bytes", files, total, 3*len(chunk))
+	}
+}
+
+func TestParseRotated(t *testing.T) {
+	at := time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local)
+	for _, c := range []struct {
+		suffix string
+		seq    int
+		ok     bool
+	}{
+		{"20240102-150405", 0, true},
+		{"20240102-150405.2", 2, true},
+		{"20240102-150405.x", 0, false},
+		{"gz", 0, false},
+	} {
+		tm, seq, ok := parseRotated(c.suffix)
+		if ok != c.ok || ok && (!tm.Equal(at) || seq != c.seq) {
+			t.Errorf("parseRotated(%q) = %v, %d, %v", c.suffix, tm, seq, ok)
+		}
+	}
+}
+
+// The age of log file survives a restart, writes don't renew it.
+func TestRotateAgeAfterRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "demo.log")
+	conf := LogConfig{File: file, Rotate: 1}
+	w, err := newRotateWriter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("started two hours ago\n"))
+	w.Close()
+
+	start := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	if err := ioutil.WriteFile(file+startSuffix, []byte(start), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = newRotateWriter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Write([]byte("after restart\n"))
+
+	files, _ := filepath.Glob(file + ".2*")
+	if len(files) != 1 {
+		t.Errorf("rotated files %v, want 1", files)
+	}
+}
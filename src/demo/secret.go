@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	gosync "sync"
+	"syscall"
+	"time"
+)
+
+// how dacli gets the password. Older dacli takes "-P <password>"
+// only, which must be chosen explicitly.
+const (
+	DacliPassArgv  string = "argv"  // "-P <password>", seen by every user in ps
+	DacliPassEnv   string = "env"   // in environment Config.DacliPassVar, the default
+	DacliPassStdin string = "stdin" // a line of stdin, with "-P -"
+)
+
+// the environment of password read by dacli, if Config.DacliPassVar is empty
+const DefaultDacliPassVar = "DACLI_PASSWORD"
+
+// the timeout of credentials command
+const passCmdTimeout = 10 * time.Second
+
+// the replacement of secrets in logs
+const redacted = "******"
+
+// envPass keeps the passwords read from environment, which is unset
+// so that child processes don't inherit it.
+var envPass = struct {
+	mu   gosync.Mutex
+	pass map[string]string
+}{pass: make(map[string]string)}
+
+// resolvePass returns the password of dam from, in order, environment
+// Config.PassEnv, file Config.PassFile, command Config.PassCmd or
+// Config.Pass itself. The environment is read once, then unset.
+func resolvePass(conf Config) (string, error) {
+	if conf.PassEnv != "" {
+		envPass.mu.Lock()
+		defer envPass.mu.Unlock()
+
+		if pass, ok := envPass.pass[conf.PassEnv]; ok {
+			return pass, nil
+		}
+		pass, ok := os.LookupEnv(conf.PassEnv)
+		if !ok {
+			return "", fmt.Errorf("environment %s not set", conf.PassEnv)
+		}
+		envPass.pass[conf.PassEnv] = pass
+		os.Unsetenv(conf.PassEnv)
+		return pass, nil
+	}
+
+	if conf.PassFile != "" {
+		return readSecretFile(conf.PassFile)
+	}
+
+	if len(conf.PassCmd) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), passCmdTimeout)
+		defer cancel()
+
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, conf.PassCmd[0], conf.PassCmd[1:]...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("credentials command %s: %v: %s", conf.PassCmd[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+
+	return conf.Pass, nil
+}
+
+// passField returns the field of conf the password comes from.
+func passField(conf Config) string {
+	switch {
+	case conf.PassEnv != "":
+		return "pass_env"
+	case conf.PassFile != "":
+		return "pass_file"
+	case len(conf.PassCmd) > 0:
+		return "pass_cmd"
+	}
+	return "pass"
+}
+
+// readSecretFile reads a secret from file, which must be a regular
+// file of the current user accessible by nobody else.
+func readSecretFile(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("secret file %s is not a regular file", file)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return "", fmt.Errorf("secret file %s is accessible by others: %v, want 0600 or 0400", file, perm)
+	}
+	if uid, ok := fileOwner(info); ok && uid != os.Getuid() {
+		return "", fmt.Errorf("secret file %s is owned by uid %d, not %d", file, uid, os.Getuid())
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func fileOwner(info os.FileInfo) (int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
+
+// secretsOf returns the secrets in conf, which are redacted in logs.
+func secretsOf(conf Config) []string {
+	secrets := []string{conf.Pass}
+	for _, t := range conf.Targets {
+		secrets = append(secrets, t.Secret)
+		for k, v := range t.Headers {
+			if strings.EqualFold(k, "Authorization") || strings.Contains(strings.ToLower(k), "token") {
+				secrets = append(secrets, v)
+			}
+		}
+	}
+	return secrets
+}
+
+// dacliCommand returns the command of dacli with the password passed
+// as Config.DacliPass.
+func dacliCommand(conf Config, args ...string) *exec.Cmd {
+	switch conf.DacliPass {
+	case DacliPassArgv:
+		return exec.Command("dacli", append(args, "-P", conf.Pass)...)
+	case DacliPassStdin:
+		cmd := exec.Command("dacli", append(args, "-P", "-")...)
+		cmd.Stdin = strings.NewReader(conf.Pass + "\n")
+		return cmd
+	}
+
+	name := conf.DacliPassVar
+	if name == "" {
+		name = DefaultDacliPassVar
+	}
+	cmd := exec.Command("dacli", args...)
+	cmd.Env = append(os.Environ(), name+"="+conf.Pass)
+	return cmd
+}
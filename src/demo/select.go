@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"time"
+)
+
+// strategy of container selection
+const (
+	SelectRoundRobin string = "round-robin"           // every container in turn
+	SelectLRS        string = "least-recently-synced" // the container synced longest ago
+	SelectWeighted   string = "weighted"              // in proportion to Config.Weights
+	SelectHealthy    string = "healthy"               // round-robin, skip containers failed
+)
+
+// a failed container is tried again after this, by healthy strategy
+const failedRetry = 10 * time.Minute
+
+// contState is the history of a container.
+type contState struct {
+	Count  int       `json:"count"`            // times selected
+	Synced time.Time `json:"synced,omitempty"` // last successful sync
+	Failed bool      `json:"failed"`           // last upload or sync failed
+	Err    string    `json:"error,omitempty"`
+	FailAt time.Time `json:"failed_at,omitempty"` // when it failed last
+
+	Current int `json:"current,omitempty"` // current weight of weighted strategy
+}
+
+// Strategy selects the container of next batch. Select may update
+// states, which are saved with the selection.
+type Strategy interface {
+	Select(conts []string, last string, states map[string]contState) string
+}
+
+func newStrategy(conf Config) (Strategy, error) {
+	switch conf.Select {
+	case "", SelectRoundRobin:
+		return roundRobin{}, nil
+	case SelectLRS:
+		return leastRecentlySynced{}, nil
+	case SelectWeighted:
+		return weighted{conf.Weights}, nil
+	case SelectHealthy:
+		return healthy{retry: failedRetry}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy: %s", conf.Select)
+}
+
+type roundRobin struct{}
+
+// Select returns the container next to last, it alternates two containers.
+func (roundRobin) Select(conts []string, last string, states map[string]contState) string {
+	for i, c := range conts {
+		if c == last {
+			return conts[(i+1)%len(conts)]
+		}
+	}
+	return conts[0]
+}
+
+type leastRecentlySynced struct{}
+
+// Select returns the container synced longest ago except last,
+// a container never synced comes first.
+func (leastRecentlySynced) Select(conts []string, last string, states map[string]contState) string {
+	var sel string
+	for _, c := range conts {
+		if c == last && len(conts) > 1 {
+			continue
+		}
+		if sel == "" || states[c].Synced.Before(states[sel].Synced) {
+			sel = c
+		}
+	}
+	return sel
+}
+
+type weighted struct {
+	weights map[string]int
+}
+
+func (w weighted) weight(cont string) int {
+	if n, ok := w.weights[cont]; ok && n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Select returns the container of the largest current weight except
+// last, by smooth weighted round-robin: every current weight grows by
+// its weight, and the selected one drops by the total. A container
+// added later starts at zero, instead of catching up in a burst.
+func (w weighted) Select(conts []string, last string, states map[string]contState) string {
+	var sel string
+	var total int
+	for _, c := range conts {
+		st := states[c]
+		st.Current += w.weight(c)
+		states[c] = st
+		total += w.weight(c)
+
+		if c == last && len(conts) > 1 {
+			continue
+		}
+		if sel == "" || st.Current > states[sel].Current {
+			sel = c
+		}
+	}
+
+	st := states[sel]
+	st.Current -= total
+	states[sel] = st
+	return sel
+}
+
+type healthy struct {
+	retry time.Duration // a failed container is tried again after it
+}
+
+func (h healthy) ok(st contState) bool {
+	return !st.Failed || time.Since(st.FailAt) >= h.retry
+}
+
+// Select returns the next container whose last upload and sync
+// succeeded or failed long enough ago. Last is selected again only if
+// all the others failed recently, and the next one if all failed.
+// A container comes back once a retried batch succeeds.
+func (h healthy) Select(conts []string, last string, states map[string]contState) string {
+	var start int
+	for i, c := range conts {
+		if c == last {
+			start = i + 1
+			break
+		}
+	}
+
+	for i := range conts {
+		c := conts[(start+i)%len(conts)]
+		if c != last && h.ok(states[c]) {
+			return c
+		}
+	}
+	if start > 0 && h.ok(states[last]) {
+		return last
+	}
+	return roundRobin{}.Select(conts, last, states)
+}
+
+// contHistory keeps the history of containers on disk, so that the
+// selection goes on after restart.
+type contHistory struct {
+	mu    gosync.Mutex
+	path  string
+	log   *Logger
+	Last  string               `json:"last"`
+	Conts map[string]contState `json:"containers"`
+}
+
+func loadHistory(dir string, log *Logger) (*contHistory, error) {
+	h := &contHistory{
+		path:  filepath.Join(dir, "containers.json"),
+		log:   log,
+		Conts: make(map[string]contState),
+	}
+
+	bytes, err := ioutil.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+
+	err = json.Unmarshal(bytes, h)
+	if err != nil {
+		return h, err
+	}
+	if h.Conts == nil {
+		h.Conts = make(map[string]contState)
+	}
+
+	h.log.Info("last container", "container", h.Last)
+	return h, nil
+}
+
+func (h *contHistory) save() error {
+	err := os.MkdirAll(filepath.Dir(h.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.MarshalIndent(h, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := h.path + ".tmp"
+	err = ioutil.WriteFile(tmp, bytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// Select selects a container with the strategy of conf.
+func (h *contHistory) Select(conf Config) string {
+	strategy, err := newStrategy(conf)
+	if err != nil {
+		// validated before
+		h.log.Error("fail to select container", "error", err)
+		strategy = roundRobin{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cont := strategy.Select(conf.Conts, h.Last, h.Conts)
+	state := h.Conts[cont]
+	state.Count++
+	h.Conts[cont] = state
+	h.Last = cont
+	if err := h.save(); err != nil {
+		h.log.Error("fail to save container history", "error", err)
+	}
+	return cont
+}
+
+// Result records the result of a batch in cont, synced is true if
+// the container is synced successfully.
+func (h *contHistory) Result(cont string, synced bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state := h.Conts[cont]
+	if synced {
+		state.Synced = time.Now()
+	}
+	state.Failed = err != nil
+	state.Err = ""
+	state.FailAt = time.Time{}
+	if err != nil {
+		state.Err = err.Error()
+		state.FailAt = time.Now()
+	}
+	h.Conts[cont] = state
+	if err := h.save(); err != nil {
+		h.log.Error("fail to save container history", "error", err)
+	}
+}
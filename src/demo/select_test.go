@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthyRetry(t *testing.T) {
+	conts := []string{"a", "b", "c"}
+	h := healthy{retry: time.Minute}
+
+	// b failed just now, skipped while a and c take turns
+	states := map[string]contState{"b": {Failed: true, FailAt: time.Now()}}
+	last := "a"
+	for i := 0; i < 4; i++ {
+		last = h.Select(conts, last, states)
+		if last == "b" {
+			t.Fatalf("selected failed container b at round %d", i)
+		}
+	}
+
+	// b is tried again once it failed long enough ago
+	states["b"] = contState{Failed: true, FailAt: time.Now().Add(-time.Minute)}
+	if c := h.Select(conts, "a", states); c != "b" {
+		t.Errorf("Select = %s, want b to be retried", c)
+	}
+
+	// all failed recently, round-robin
+	now := time.Now()
+	for _, c := range conts {
+		states[c] = contState{Failed: true, FailAt: now}
+	}
+	if c := h.Select(conts, "a", states); c != "b" {
+		t.Errorf("Select = %s, want b by round-robin", c)
+	}
+}
+
+// With two containers, the healthy one is repeated while the other
+// failed recently.
+func TestHealthyTwo(t *testing.T) {
+	conts := []string{"a", "b"}
+	h := healthy{retry: time.Minute}
+
+	states := map[string]contState{"b": {Failed: true, FailAt: time.Now()}}
+	if c := h.Select(conts, "a", states); c != "a" {
+		t.Errorf("Select = %s, want a repeated", c)
+	}
+}
+
+// A container added later doesn't take a burst of selections, and
+// none is selected twice in a row.
+func TestWeightedSmooth(t *testing.T) {
+	w := weighted{map[string]int{"a": 2}}
+	states := map[string]contState{"a": {Count: 100}, "b": {Count: 100}}
+	conts := []string{"a", "b"}
+	last := "b"
+	for i := 0; i < 4; i++ {
+		last = w.Select(conts, last, states)
+	}
+
+	conts = append(conts, "c")
+	counts := make(map[string]int)
+	for i := 0; i < 12; i++ {
+		c := w.Select(conts, last, states)
+		if c == last {
+			t.Fatalf("selected %s twice in a row at round %d", c, i)
+		}
+		counts[c]++
+		last = c
+	}
+	if counts["a"] != 6 || counts["b"] != 3 || counts["c"] != 3 {
+		t.Errorf("selections %v, want a 6, b 3 and c 3", counts)
+	}
+}
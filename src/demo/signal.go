@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+)
+
+// protocol of signals to the show controller
+const (
+	ProtoRaw      string = "raw"      // the code only, as old controllers expect
+	ProtoReliable string = "reliable" // sequence numbered, acknowledged
+)
+
+// default of reliable protocol
+const (
+	DefaultAckTimeout = 500 // milliseconds
+	DefaultRetransmit = 5
+)
+
+// In reliable protocol, a message is "<session>:<seq>:<code>" and the
+// receiver replies "ack:<session>:<seq>". The session is the start time
+// of sender, so that the receiver knows a restarted sender.
+var (
+	session = strconv.FormatInt(time.Now().UnixNano(), 36)
+	seq     uint64
+)
+
+func encodeSignal(session string, seq uint64, code string) string {
+	return session + ":" + strconv.FormatUint(seq, 10) + ":" + code
+}
+
+func decodeSignal(msg string) (session string, seq uint64, code string, err error) {
+	parts := strings.SplitN(msg, ":", 3)
+	if len(parts) != 3 {
+		return "", 0, "", fmt.Errorf("invalid signal: %q", msg)
+	}
+
+	seq, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("invalid signal: %q", msg)
+	}
+	return parts[0], seq, parts[2], nil
+}
+
+func encodeAck(session string, seq uint64) string {
+	return "ack:" + session + ":" + strconv.FormatUint(seq, 10)
+}
+
+// sendRaw sends code in a datagram.
+func sendRaw(addr, code string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(code))
+	return err
+}
+
+// sendReliable sends code with a sequence number, and retransmits
+// it until acknowledged or retries run out.
+func sendReliable(addr, code string, timeout time.Duration, retries int, log *Logger) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	n := atomic.AddUint64(&seq, 1)
+	msg := []byte(encodeSignal(session, n, code))
+	ack := encodeAck(session, n)
+
+	buf := make([]byte, 512)
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			log.Warn("retransmit signal", "code", code, "seq", n, "attempt", i)
+		}
+
+		_, err = conn.Write(msg)
+		if err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(timeout)
+		for {
+			conn.SetReadDeadline(deadline)
+			m, err := conn.Read(buf)
+			if err != nil {
+				// connection refused reported by icmp returns at once,
+				// wait until timeout as well before retransmission
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					time.Sleep(time.Until(deadline))
+				}
+				break
+			}
+			if string(buf[:m]) == ack {
+				return nil
+			}
+			// ack of an earlier message retransmitted
+		}
+	}
+
+	return fmt.Errorf("signal %s seq %d not acknowledged", code, n)
+}
+
+// signalReceiver receives signals in reliable protocol, acknowledges
+// them and drops duplicates. It is the reference of the controller side.
+type signalReceiver struct {
+	mu      gosync.Mutex
+	session string
+	last    uint64          // the largest sequence received
+	seen    map[uint64]bool // sequences received in current session
+}
+
+// maxSeen bounds the memory of received sequences
+const maxSeen = 1024
+
+// Accept reports whether the message is new, and returns the ack.
+func (r *signalReceiver) Accept(msg string) (code string, ack string, isNew bool, err error) {
+	session, seq, code, err := decodeSignal(msg)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ack = encodeAck(session, seq)
+	if olderSession(session, r.session) {
+		// delayed from before the sender restarted
+		return code, ack, false, nil
+	}
+	if session != r.session {
+		// sender restarted
+		r.session = session
+		r.last = 0
+		r.seen = make(map[uint64]bool)
+	}
+
+	if r.seen[seq] || (r.last > maxSeen && seq <= r.last-maxSeen) {
+		return code, ack, false, nil
+	}
+
+	r.seen[seq] = true
+	if seq > r.last {
+		r.last = seq
+	}
+	for s := range r.seen {
+		if r.last > maxSeen && s <= r.last-maxSeen {
+			delete(r.seen, s)
+		}
+	}
+	return code, ack, true, nil
+}
+
+// olderSession reports whether session a started before b. Sessions
+// are start times in base 36, a longer one is later.
+func olderSession(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// receiveSignals listens on addr, and calls f for every new signal.
+func receiveSignals(addr string, f func(code string)) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var r signalReceiver
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		code, ack, isNew, err := r.Accept(string(buf[:n]))
+		if err != nil {
+			logger.Warn("invalid signal", "from", from, "error", err)
+			continue
+		}
+
+		conn.WriteTo([]byte(ack), from)
+		if isNew {
+			f(code)
+		} else {
+			logger.Debug("duplicate signal", "from", from, "code", code)
+		}
+	}
+}
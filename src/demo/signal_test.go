@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+// lossyReceiver runs signalReceiver on a udp socket, dropping the
+// datagrams and acks chosen by their order of arrival, from 0.
+type lossyReceiver struct {
+	mu       gosync.Mutex
+	dropMsg  map[int]bool
+	dropAck  map[int]bool
+	received int
+	codes    []string // new signals
+}
+
+func newLossyReceiver(t *testing.T, dropMsg, dropAck map[int]bool) (*lossyReceiver, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	l := &lossyReceiver{dropMsg: dropMsg, dropAck: dropAck}
+	go func() {
+		var r signalReceiver
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			l.mu.Lock()
+			i := l.received
+			l.received++
+			if l.dropMsg[i] {
+				l.mu.Unlock()
+				continue
+			}
+			code, ack, isNew, err := r.Accept(string(buf[:n]))
+			if err == nil && isNew {
+				l.codes = append(l.codes, code)
+			}
+			l.mu.Unlock()
+
+			if err == nil && !l.dropAck[i] {
+				conn.WriteTo([]byte(ack), from)
+			}
+		}
+	}()
+	return l, conn.LocalAddr().String()
+}
+
+func (l *lossyReceiver) result() (int, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.received, l.codes
+}
+
+var testLog = &Logger{level: LevelError, format: FormatText, out: ioutil.Discard}
+
+func TestReliableDroppedSignal(t *testing.T) {
+	l, addr := newLossyReceiver(t, map[int]bool{0: true}, nil)
+
+	if err := sendReliable(addr, UploadStart, 50*time.Millisecond, 3, testLog); err != nil {
+		t.Fatal(err)
+	}
+	received, codes := l.result()
+	if received != 2 || len(codes) != 1 || codes[0] != UploadStart {
+		t.Errorf("received %d datagrams of new signals %v, want 2 of [%s]", received, codes, UploadStart)
+	}
+}
+
+func TestReliableDroppedAck(t *testing.T) {
+	l, addr := newLossyReceiver(t, nil, map[int]bool{0: true})
+
+	if err := sendReliable(addr, UploadStart, 50*time.Millisecond, 3, testLog); err != nil {
+		t.Fatal(err)
+	}
+	// the retransmission is a duplicate, acknowledged only
+	received, codes := l.result()
+	if received != 2 || len(codes) != 1 {
+		t.Errorf("received %d datagrams of new signals %v, want 2 of 1", received, codes)
+	}
+}
+
+func TestReliableNotAcknowledged(t *testing.T) {
+	_, addr := newLossyReceiver(t, map[int]bool{0: true, 1: true, 2: true}, nil)
+
+	if err := sendReliable(addr, UploadStart, 20*time.Millisecond, 2, testLog); err == nil {
+		t.Error("send succeeded without ack")
+	}
+}
+
+func TestReceiverDuplicate(t *testing.T) {
+	var r signalReceiver
+	msg := encodeSignal("abc", 1, SyncDone)
+
+	code, ack, isNew, err := r.Accept(msg)
+	if err != nil || !isNew || code != SyncDone || ack != encodeAck("abc", 1) {
+		t.Fatalf("Accept = %q, %q, %v, %v", code, ack, isNew, err)
+	}
+	if _, ack, isNew, _ := r.Accept(msg); isNew || ack != encodeAck("abc", 1) {
+		t.Errorf("duplicate accepted as new, ack %q", ack)
+	}
+}
+
+// A datagram delayed from before the sender restarted must not reset
+// the session, duplicates of the new one are still dropped.
+func TestReceiverOldSession(t *testing.T) {
+	var r signalReceiver
+	old, cur := "abc", "abd"
+
+	r.Accept(encodeSignal(old, 1, SyncStart))
+	r.Accept(encodeSignal(cur, 1, SyncDone))
+
+	if _, _, isNew, _ := r.Accept(encodeSignal(old, 2, SyncStart)); isNew {
+		t.Error("delayed signal of old session accepted as new")
+	}
+	if _, _, isNew, _ := r.Accept(encodeSignal(cur, 1, SyncDone)); isNew {
+		t.Error("duplicate accepted as new after a delayed signal")
+	}
+	if _, _, isNew, _ := r.Accept(encodeSignal("abcd", 1, SyncStart)); !isNew {
+		t.Error("signal of a later session dropped")
+	}
+}
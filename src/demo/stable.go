@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// StableConfig is the configuration of checking whether a file is
+// completely written. Writers over samba don't always chmod, and a
+// large file can pause in the middle of writing.
+type StableConfig struct {
+	Window int      `json:"window"`         // seconds size and mtime unchanged
+	Lock   bool     `json:"lock,omitempty"` // try an exclusive lock of the file
+	Temp   []string `json:"temp,omitempty"` // patterns of temporary file names
+}
+
+// fileStat is a file observed by stability checker.
+type fileStat struct {
+	size  int64
+	mtime time.Time
+	since time.Time // when size and mtime were seen changed
+	ready bool      // the file is completely written
+}
+
+// stability polls size and mtime of pending files of a pipeline.
+type stability struct {
+	p     *pipeline
+	files map[string]*fileStat // key: file relative to samba directory watched
+}
+
+func newStability(p *pipeline) *stability {
+	return &stability{p: p, files: make(map[string]*fileStat)}
+}
+
+// Check polls file, and reports whether it is completely written.
+// gone is true if file no longer exists, e.g. a temporary file renamed.
+func (s *stability) Check(file string) (ready bool, gone bool) {
+	conf := s.p.getConf()
+
+	info, err := os.Stat(filepath.Join(s.p.root, filepath.FromSlash(file)))
+	if err != nil {
+		s.p.log.Debug("file is gone", "file", file, "error", err)
+		s.Forget(file)
+		return false, true
+	}
+
+	if isTemp(file, conf.Stable.Temp) {
+		s.p.log.Debug("skip temporary file", "file", file)
+		return false, false
+	}
+
+	now := time.Now()
+	st, ok := s.files[file]
+	if !ok || st.size != info.Size() || !st.mtime.Equal(info.ModTime()) {
+		st = &fileStat{size: info.Size(), mtime: info.ModTime(), since: now}
+		s.files[file] = st
+	}
+
+	window := time.Duration(conf.Stable.Window) * time.Second
+	if now.Sub(st.since) < window {
+		s.p.log.Debug("file not stable", "file", file, "size", st.size, "since", st.since)
+		st.ready = false
+		return false, false
+	}
+
+	if conf.Stable.Lock && !tryLock(filepath.Join(s.p.root, filepath.FromSlash(file))) {
+		s.p.log.Debug("file is locked", "file", file)
+		st.ready = false
+		return false, false
+	}
+
+	st.ready = true
+	return true, false
+}
+
+// Ready reports the result of the last check of file.
+func (s *stability) Ready(file string) bool {
+	st, ok := s.files[file]
+	return ok && st.ready
+}
+
+// Size returns the size of file seen in the last check.
+func (s *stability) Size(file string) int64 {
+	if st, ok := s.files[file]; ok {
+		return st.size
+	}
+	return 0
+}
+
+func (s *stability) Forget(file string) {
+	delete(s.files, file)
+}
+
+func (s *stability) Reset() {
+	s.files = make(map[string]*fileStat)
+}
+
+// isTemp reports whether the base name of file matches any of patterns.
+func isTemp(file string, patterns []string) bool {
+	base := path.Base(file)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tryLock reports whether an exclusive lock of file can be taken,
+// i.e. no writer holds a lock. The lock is released at once.
+func tryLock(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return false
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return true
+}
+
+// savePending saves the files not completely written at exit in dir,
+// which are checked again at next start instead of being uploaded.
+// The saved list is removed if files is empty.
+func savePending(dir string, files []string) error {
+	file := filepath.Join(dir, "pending.json")
+	if len(files) == 0 {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(files, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that a crash
+	// never leaves a truncated list behind
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, bytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// loadPending returns the files saved by savePending, which are
+// forgotten once loaded.
+func loadPending(dir string) ([]string, error) {
+	file := filepath.Join(dir, "pending.json")
+	bytes, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err = json.Unmarshal(bytes, &files)
+	if err != nil {
+		return nil, err
+	}
+	return files, os.Remove(file)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	gosync "sync"
+	"time"
+)
+
+// State is the state of the show lifecycle.
+type State int
+
+const (
+	StateIdle      State = iota // waiting for data
+	StateStreaming              // data varying
+	StateCooling                // data invariant, batch waiting for handler
+	StateUploading
+	StateSyncing
+	StateTail
+	StateError
+)
+
+var stateNames = []string{"idle", "streaming", "cooling", "uploading", "syncing", "tail", "error"}
+
+func (s State) String() string {
+	if s < StateIdle || s > StateError {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Show is the state machine of the show lifecycle. Every transition
+// emits the signal codes to the show controller, the codes are emitted
+// with the lock held, so their order follows the order of transitions.
+//
+//	Idle      --data-->       Streaming   StreamStart
+//	Streaming --batch-->      Cooling     StreamDone
+//	*         --upload-->     Uploading   UploadStart
+//	Uploading --uploaded-->   Syncing     UploadDone or UploadErr, SyncStart
+//	Syncing   --synced-->     Tail        SyncDone or SyncErr, TailStart
+//	Tail      --data-->       Streaming   StreamStart, the tail ends silently
+//	Tail      --tail end-->   Idle        TailEnd, WaitStart
+//	Tail      --tail end-->   Streaming   if data is varying
+//	*         --failure-->    Error       SymErr
+type Show struct {
+	mu      gosync.Mutex
+	name    string // of pipeline, reported with signals
+	state   State
+	varying bool  // data varies since the last quiet second
+	batch   Batch // the batch being handled, reported with signals
+	emit    func(ev signalEvent)
+	log     *Logger
+}
+
+// Batch is the detail of the batch being handled.
+type Batch struct {
+	Id     int
+	Level  int
+	Cont   string
+	Files  []string
+	Failed []string      // files failed to upload
+	Bytes  int64         // bytes uploaded
+	Upload time.Duration // duration of uploading
+	Sync   time.Duration // duration of syncing
+	Err    error         // error of uploading or syncing
+}
+
+func newShow(name string, log *Logger, emit func(ev signalEvent)) *Show {
+	return &Show{name: name, state: StateIdle, emit: emit, log: log}
+}
+
+// signal emits code with the detail of current batch.
+func (s *Show) signal(code string, err error) {
+	ev := signalEvent{
+		Code:     code,
+		Msg:      msgInfo[code],
+		Time:     time.Now(),
+		Pipeline: s.name,
+		Batch:    s.batch.Id,
+		Level:    s.batch.Level,
+		Cont:     s.batch.Cont,
+		Files:    s.batch.Files,
+		Failed:   s.batch.Failed,
+		Bytes:    s.batch.Bytes,
+		Upload:   s.batch.Upload.Seconds(),
+		Sync:     s.batch.Sync.Seconds(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	s.emit(ev)
+}
+
+func (s *Show) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// Varying reports whether data varies since the last quiet second.
+func (s *Show) Varying() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.varying
+}
+
+func (s *Show) set(state State) {
+	if s.state != state {
+		s.log.Debug("show state", "from", s.state, "to", state)
+		s.state = state
+	}
+}
+
+// DataChanged is called on every file event, signal is false for
+// events which should not start streaming, e.g. remove.
+func (s *Show) DataChanged(signal bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// send the signal once
+	if s.varying {
+		return
+	}
+	s.varying = true
+
+	if !signal {
+		return
+	}
+	s.signal(StreamStart, nil)
+	switch s.state {
+	case StateIdle, StateTail, StateError:
+		s.set(StateStreaming)
+	}
+}
+
+// Quiet is called every second without file event.
+func (s *Show) Quiet() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.varying = false
+}
+
+// BatchReady is called when data is invariant and the pending
+// files are emitted as a batch.
+func (s *Show) BatchReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signal(StreamDone, nil)
+	if s.state == StateStreaming {
+		s.set(StateCooling)
+	}
+}
+
+func (s *Show) StartUpload(b Batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batch = b
+	s.set(StateUploading)
+	s.signal(UploadStart, nil)
+}
+
+// EndUpload ends uploading of batch b, which fails if b.Err is not nil.
+func (s *Show) EndUpload(b Batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != StateUploading {
+		s.log.Warn("unexpected show transition", "state", s.state, "to", StateSyncing)
+	}
+
+	s.batch = b
+	if b.Err != nil {
+		s.signal(UploadErr, b.Err)
+	} else {
+		s.signal(UploadDone, nil)
+	}
+	s.set(StateSyncing)
+	s.signal(SyncStart, nil)
+}
+
+// EndSync ends syncing of batch b, which fails if b.Err is not nil.
+func (s *Show) EndSync(b Batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != StateSyncing {
+		s.log.Warn("unexpected show transition", "state", s.state, "to", StateTail)
+	}
+
+	s.batch = b
+	if b.Err != nil {
+		s.signal(SyncErr, b.Err)
+	} else {
+		s.signal(SyncDone, nil)
+	}
+	s.set(StateTail)
+	s.signal(TailStart, nil)
+}
+
+// EndTail ends the tail work of show, unless data is varying.
+func (s *Show) EndTail() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == StateStreaming {
+		// data started during the tail, a new show is going on
+		s.batch = Batch{}
+		return
+	}
+	if s.state != StateTail {
+		s.log.Warn("unexpected show transition", "state", s.state, "to", StateIdle)
+		return
+	}
+
+	if s.varying {
+		s.batch = Batch{}
+		s.set(StateStreaming)
+		return
+	}
+	s.signal(TailEnd, nil)
+	s.batch = Batch{}
+	s.signal(WaitStart, nil)
+	s.set(StateIdle)
+}
+
+// Fail reports a system error.
+func (s *Show) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signal(SymErr, err)
+
+	// a batch being handled goes on
+	if s.state != StateUploading && s.state != StateSyncing {
+		s.set(StateError)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordShow returns a show recording the codes it emits, and the
+// buffer of warnings it logs.
+func recordShow() (*Show, *[]string, *bytes.Buffer) {
+	var codes []string
+	var warns bytes.Buffer
+	log := &Logger{level: LevelWarn, format: FormatText, out: &warns}
+	s := newShow("test", log, func(ev signalEvent) {
+		codes = append(codes, ev.Code)
+	})
+	return s, &codes, &warns
+}
+
+// runBatch drives s through uploading and syncing a batch.
+func runBatch(s *Show, upErr, syncErr error) {
+	s.DataChanged(true)
+	s.Quiet()
+	s.BatchReady()
+	s.StartUpload(Batch{Id: 1, Cont: "hello"})
+	s.EndUpload(Batch{Id: 1, Cont: "hello", Err: upErr})
+	s.EndSync(Batch{Id: 1, Cont: "hello", Err: syncErr})
+}
+
+func checkShow(t *testing.T, s *Show, codes []string, warns *bytes.Buffer, want []string, state State) {
+	t.Helper()
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("codes = %v, want %v", codes, want)
+	}
+	if s.State() != state {
+		t.Errorf("state = %v, want %v", s.State(), state)
+	}
+	if warns.Len() > 0 {
+		t.Errorf("unexpected warnings: %s", warns)
+	}
+}
+
+func TestShowBatch(t *testing.T) {
+	s, codes, warns := recordShow()
+
+	runBatch(s, nil, nil)
+	s.EndTail()
+
+	want := []string{
+		StreamStart, StreamDone,
+		UploadStart, UploadDone,
+		SyncStart, SyncDone,
+		TailStart, TailEnd, WaitStart,
+	}
+	checkShow(t, s, *codes, warns, want, StateIdle)
+}
+
+func TestShowStreamStartOnce(t *testing.T) {
+	s, codes, warns := recordShow()
+
+	s.DataChanged(true)
+	s.DataChanged(true)
+	s.Quiet()
+	s.DataChanged(false) // a remove doesn't start streaming
+
+	checkShow(t, s, *codes, warns, []string{StreamStart}, StateStreaming)
+}
+
+func TestShowDataDuringTail(t *testing.T) {
+	s, codes, warns := recordShow()
+
+	runBatch(s, nil, nil)
+	s.Quiet()
+	s.DataChanged(true)
+	s.EndTail()
+
+	// no TailEnd or WaitStart, a new show is streaming
+	want := []string{
+		StreamStart, StreamDone,
+		UploadStart, UploadDone,
+		SyncStart, SyncDone,
+		TailStart, StreamStart,
+	}
+	checkShow(t, s, *codes, warns, want, StateStreaming)
+}
+
+func TestShowVaryingAtTailEnd(t *testing.T) {
+	s, codes, warns := recordShow()
+
+	// a remove during tail varies data without streaming
+	runBatch(s, nil, nil)
+	s.Quiet()
+	s.DataChanged(false)
+	s.EndTail()
+
+	want := []string{
+		StreamStart, StreamDone,
+		UploadStart, UploadDone,
+		SyncStart, SyncDone,
+		TailStart,
+	}
+	checkShow(t, s, *codes, warns, want, StateStreaming)
+}
+
+func TestShowFailures(t *testing.T) {
+	s, codes, warns := recordShow()
+
+	runBatch(s, errors.New("upload"), errors.New("sync"))
+	s.EndTail()
+
+	want := []string{
+		StreamStart, StreamDone,
+		UploadStart, UploadErr,
+		SyncStart, SyncErr,
+		TailStart, TailEnd, WaitStart,
+	}
+	checkShow(t, s, *codes, warns, want, StateIdle)
+}
+
+func TestShowSystemError(t *testing.T) {
+	s, codes, warns := recordShow()
+
+	// a batch being handled goes on
+	s.DataChanged(true)
+	s.Quiet()
+	s.BatchReady()
+	s.StartUpload(Batch{Id: 1})
+	s.Fail(errors.New("watcher"))
+	if s.State() != StateUploading {
+		t.Errorf("state = %v after failure during upload, want %v", s.State(), StateUploading)
+	}
+	s.EndUpload(Batch{Id: 1})
+	s.EndSync(Batch{Id: 1})
+	s.EndTail()
+
+	// otherwise the show is in error until data comes
+	s.Fail(errors.New("watcher"))
+	if s.State() != StateError {
+		t.Errorf("state = %v after failure, want %v", s.State(), StateError)
+	}
+	s.DataChanged(true)
+
+	want := []string{
+		StreamStart, StreamDone,
+		UploadStart, SymErr, UploadDone,
+		SyncStart, SyncDone,
+		TailStart, TailEnd, WaitStart,
+		SymErr, StreamStart,
+	}
+	checkShow(t, s, *codes, warns, want, StateStreaming)
+}
+
+func TestShowUnexpectedTransition(t *testing.T) {
+	s, codes, warns := recordShow()
+
+	// a tail end without a batch is ignored
+	s.EndTail()
+	if len(*codes) > 0 || s.State() != StateIdle {
+		t.Errorf("codes = %v, state = %v, want none and idle", *codes, s.State())
+	}
+	if !strings.Contains(warns.String(), "unexpected show transition") {
+		t.Errorf("warnings = %q, want unexpected show transition", warns)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ConfError is a problem of a configuration field,
+// the field is named as in the configuration file.
+type ConfError struct {
+	Field string
+	Msg   string
+}
+
+func (e ConfError) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+// ConfErrors is all problems found in a configuration.
+type ConfErrors []ConfError
+
+func (e ConfErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// validateConf checks every field of conf, returns ConfErrors
+// if any problem is found.
+func validateConf(conf Config) error {
+	var errs ConfErrors
+	add := func(field, format string, a ...interface{}) {
+		errs = append(errs, ConfError{Field: field, Msg: fmt.Sprintf(format, a...)})
+	}
+
+	// the process
+	if conf.Admin != "" {
+		if err := checkListen(conf.Admin); err != nil {
+			add("admin", "%v", err)
+		}
+	}
+	if conf.Metrics != "" {
+		if err := checkListen(conf.Metrics); err != nil {
+			add("metrics", "%v", err)
+		}
+	}
+	if conf.Shutdown < 0 {
+		add("shutdown", "negative value %d", conf.Shutdown)
+	}
+
+	if len(conf.Pipelines) == 0 {
+		validatePipeline(conf, add)
+	} else {
+		validatePipelines(conf, add)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validatePipelines checks each pipeline as a configuration of its own,
+// and that pipelines don't share samba or state directories.
+func validatePipelines(conf Config, add func(field, format string, a ...interface{})) {
+	var confs []Config
+	for i, pc := range conf.Pipelines {
+		field := fmt.Sprintf("pipelines[%d]", i)
+		for _, f := range processFields {
+			if hasField(pc, f) {
+				add(field+"."+f, "not allowed in a pipeline")
+			}
+		}
+
+		c, err := pipelineConf(conf, pc)
+		if err != nil {
+			add(field, "%v", err)
+			continue
+		}
+
+		if c.Name == "" {
+			add(field+".name", "empty name")
+		} else if c.Name != filepath.Base(c.Name) || c.Name == "." || c.Name == ".." {
+			add(field+".name", "invalid name %q", c.Name)
+		}
+		for _, o := range confs {
+			if c.Name == o.Name {
+				add(field+".name", "duplicate name %q", c.Name)
+			}
+			if c.Samba != "" && o.Samba != "" && (inTree(c.Samba, o.Samba) || inTree(o.Samba, c.Samba)) {
+				add(field+".samba", "overlaps samba directory of pipeline %q", o.Name)
+			}
+			if stateDir(c) == stateDir(o) {
+				add(field+".state", "shared with pipeline %q", o.Name)
+			}
+		}
+		confs = append(confs, c)
+
+		validatePipeline(c, func(f, format string, a ...interface{}) {
+			add(field+"."+f, format, a...)
+		})
+	}
+}
+
+// validatePipeline checks the fields of a pipeline.
+func validatePipeline(conf Config, add func(field, format string, a ...interface{})) {
+	// signal targets
+	if conf.Udp == "" {
+		if len(conf.Targets) == 0 && conf.Tcp == "" {
+			add("udp", "empty address")
+		}
+	} else if err := checkAddr(conf.Udp); err != nil {
+		add("udp", "%v", err)
+	}
+	names := make(map[string]bool)
+	for i, t := range conf.Targets {
+		field := fmt.Sprintf("targets[%d]", i)
+		if t.Name == "" {
+			add(field+".name", "empty name")
+		} else if names[t.Name] {
+			add(field+".name", "duplicate name %q", t.Name)
+		}
+		names[t.Name] = true
+
+		switch t.Proto {
+		case TargetUdp, TargetReliable, TargetGob, TargetNdjson:
+			if err := checkAddr(t.Addr); err != nil {
+				add(field+".addr", "%v", err)
+			}
+		case TargetHttp:
+			if u, err := url.Parse(t.Addr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add(field+".addr", "invalid url %q", t.Addr)
+			}
+		default:
+			add(field+".proto", "unknown protocol %q", t.Proto)
+		}
+
+		for _, code := range t.Codes {
+			if _, ok := msgInfo[code]; !ok {
+				add(field+".codes", "unknown code %q", code)
+			}
+		}
+		if t.Queue < 0 {
+			add(field+".queue", "negative value %d", t.Queue)
+		}
+		if t.Proto != TargetHttp && (len(t.Headers) > 0 || t.Secret != "" || t.Retry != 0) {
+			add(field, "headers, secret and retry are for http only")
+		}
+		if t.Retry < 0 {
+			add(field+".retry", "negative value %d", t.Retry)
+		}
+	}
+	if conf.Tcp != "" {
+		if err := checkAddr(conf.Tcp); err != nil {
+			add("tcp", "%v", err)
+		}
+	}
+
+	switch conf.Protocol {
+	case "", ProtoRaw, ProtoReliable:
+	default:
+		add("protocol", "unknown protocol %q", conf.Protocol)
+	}
+
+	// samba directory
+	if conf.Samba == "" {
+		add("samba", "empty directory")
+	} else if err := checkDir(conf.Samba); err != nil {
+		add("samba", "%v", err)
+	}
+
+	// timings
+	for _, v := range []struct {
+		field string
+		value int
+	}{
+		{"cool", conf.Cool},
+		{"gap", conf.Gap},
+		{"retry", conf.Retry},
+		{"backoff", conf.Backoff},
+		{"workers", conf.Workers},
+		{"poll", conf.Poll},
+		{"ack_timeout", conf.AckTimeout},
+		{"retransmit", conf.Retransmit},
+	} {
+		if v.value < 0 {
+			add(v.field, "negative value %d", v.value)
+		}
+	}
+
+	// containers are used alternately
+	distinct := make(map[string]bool)
+	for i, cont := range conf.Conts {
+		if cont == "" {
+			add("container", "empty name at index %d", i)
+			continue
+		}
+		distinct[cont] = true
+	}
+	if len(distinct) < 2 {
+		add("container", "need at least two distinct containers, got %d", len(distinct))
+	}
+
+	switch conf.Select {
+	case "", SelectRoundRobin, SelectLRS, SelectWeighted, SelectHealthy:
+	default:
+		add("select", "unknown strategy %q", conf.Select)
+	}
+	for cont, w := range conf.Weights {
+		if !distinct[cont] {
+			add("weights", "unknown container %q", cont)
+		}
+		if w <= 0 {
+			add("weights", "non-positive weight %d of %q", w, cont)
+		}
+	}
+
+	// dam
+	if conf.Dam == "" {
+		add("dam", "empty address")
+	}
+	if conf.Tenant == "" {
+		add("tenant", "empty tenant")
+	}
+	if conf.User == "" {
+		add("user", "empty user")
+	}
+	if conf.passErr != nil {
+		add(passField(conf), "%v", conf.passErr)
+	} else if conf.Pass == "" {
+		add(passField(conf), "empty password")
+	}
+	switch conf.DacliPass {
+	case "", DacliPassArgv, DacliPassEnv, DacliPassStdin:
+	default:
+		add("dacli_pass", "unknown way %q", conf.DacliPass)
+	}
+
+	switch conf.Backend {
+	case "", BackendDam, BackendDacli:
+	default:
+		add("backend", "unknown backend %q", conf.Backend)
+	}
+
+	if conf.Checksum != ChecksumNone {
+		if _, err := newHash(conf.Checksum); err != nil {
+			add("checksum", "unknown algorithm %q", conf.Checksum)
+		}
+		// dacli can't stat objects, the checksum would never be verified
+		if conf.Backend != BackendDam {
+			add("checksum", "%s requires backend %s", conf.Checksum, BackendDam)
+		}
+	}
+
+	switch conf.Watcher {
+	case "", WatcherFsnotify, WatcherPoll:
+	default:
+		add("watcher", "unknown watcher %q", conf.Watcher)
+	}
+
+	// stability
+	if conf.Stable.Window < 0 {
+		add("stable.window", "negative value %d", conf.Stable.Window)
+	}
+	for i, p := range conf.Stable.Temp {
+		if _, err := path.Match(p, ""); err != nil {
+			add(fmt.Sprintf("stable.temp[%d]", i), "invalid pattern %q", p)
+		}
+	}
+
+	// filter
+	for _, v := range []struct {
+		field    string
+		patterns []string
+	}{
+		{"filter.include", conf.Filter.Include},
+		{"filter.exclude", conf.Filter.Exclude},
+	} {
+		for i, p := range v.patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				add(fmt.Sprintf("%s[%d]", v.field, i), "invalid pattern %q", p)
+			}
+		}
+	}
+	for _, v := range []struct {
+		field    string
+		patterns []string
+	}{
+		{"filter.include_re", conf.Filter.IncludeRe},
+		{"filter.exclude_re", conf.Filter.ExcludeRe},
+	} {
+		for i, p := range v.patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				add(fmt.Sprintf("%s[%d]", v.field, i), "%v", err)
+			}
+		}
+	}
+	if conf.Filter.MinSize < 0 {
+		add("filter.min_size", "negative value %d", conf.Filter.MinSize)
+	}
+	if conf.Filter.MaxSize < 0 {
+		add("filter.max_size", "negative value %d", conf.Filter.MaxSize)
+	} else if conf.Filter.MaxSize > 0 && conf.Filter.MaxSize < conf.Filter.MinSize {
+		add("filter.max_size", "less than min_size %d", conf.Filter.MinSize)
+	}
+
+	// priority
+	for i, r := range conf.Priority.Rules {
+		field := fmt.Sprintf("priority.rules[%d]", i)
+		for j, p := range r.Glob {
+			if _, err := path.Match(p, ""); err != nil {
+				add(fmt.Sprintf("%s.glob[%d]", field, j), "invalid pattern %q", p)
+			}
+		}
+		for j, p := range r.Regex {
+			if _, err := regexp.Compile(p); err != nil {
+				add(fmt.Sprintf("%s.regex[%d]", field, j), "%v", err)
+			}
+		}
+		if r.MinSize < 0 {
+			add(field+".min_size", "negative value %d", r.MinSize)
+		}
+		if r.MaxSize < 0 {
+			add(field+".max_size", "negative value %d", r.MaxSize)
+		} else if r.MaxSize > 0 && r.MaxSize < r.MinSize {
+			add(field+".max_size", "less than min_size %d", r.MinSize)
+		}
+	}
+	if conf.Priority.Aging <= 0 {
+		add("priority.aging", "non-positive value %d, low levels would starve", conf.Priority.Aging)
+	}
+
+	// log
+	if _, err := parseLevel(conf.Log.Level); err != nil {
+		add("log.level", "unknown level %q", conf.Log.Level)
+	}
+	switch conf.Log.Format {
+	case "", FormatText, FormatJSON:
+	default:
+		add("log.format", "unknown format %q", conf.Log.Format)
+	}
+	for _, v := range []struct {
+		field string
+		value int
+	}{
+		{"log.max_size", conf.Log.MaxSize},
+		{"log.rotate", conf.Log.Rotate},
+		{"log.backups", conf.Log.Backups},
+		{"log.max_age", conf.Log.MaxAge},
+	} {
+		if v.value < 0 {
+			add(v.field, "negative value %d", v.value)
+		}
+	}
+}
+
+// checkAddr checks the syntax of address "host:port".
+func checkAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("empty host in %q", addr)
+	}
+	return checkListen(addr)
+}
+
+// checkListen checks the syntax of listen address "[host]:port".
+func checkListen(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+	return nil
+}
+
+// checkDir checks that dir is a readable directory.
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"syscall"
+	"time"
+)
+
+// watcher of samba directory
+const (
+	WatcherFsnotify string = "fsnotify" // inotify, misses changes of remote clients on cifs
+	WatcherPoll     string = "poll"     // scan directories periodically
+)
+
+// default seconds between scans of poll watcher
+const DefaultPoll = 2
+
+// Watcher produces events of files in the directories added, but not
+// in their subdirectories. A new subdirectory is reported by Create.
+type Watcher interface {
+	Add(dir string) error
+	Remove(dir string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+func newWatcher(conf Config) (Watcher, error) {
+	switch conf.Watcher {
+	case "", WatcherFsnotify:
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		return fsnotifyWatcher{w}, nil
+	case WatcherPoll:
+		interval := time.Duration(conf.Poll) * time.Second
+		if interval <= 0 {
+			interval = DefaultPoll * time.Second
+		}
+		return newPollWatcher(interval), nil
+	}
+	return nil, fmt.Errorf("unknown watcher: %s", conf.Watcher)
+}
+
+type fsnotifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func (w fsnotifyWatcher) Events() <-chan fsnotify.Event { return w.Watcher.Events }
+func (w fsnotifyWatcher) Errors() <-chan error          { return w.Watcher.Errors }
+
+// fileSnap is a file seen by poll watcher.
+type fileSnap struct {
+	size  int64
+	mtime time.Time
+	mode  os.FileMode
+	ino   uint64
+}
+
+func snapOf(info os.FileInfo) fileSnap {
+	s := fileSnap{size: info.Size(), mtime: info.ModTime(), mode: info.Mode()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		s.ino = st.Ino
+	}
+	return s
+}
+
+// pollWatcher scans the directories added periodically, and diffs
+// against the previous snapshot to produce events as fsnotify does.
+type pollWatcher struct {
+	mu       gosync.Mutex
+	interval time.Duration
+	dirs     map[string]map[string]fileSnap // dir -> name -> snapshot
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan bool
+	once     gosync.Once
+}
+
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		interval: interval,
+		dirs:     make(map[string]map[string]fileSnap),
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan bool),
+	}
+	go w.loop()
+	return w
+}
+
+func (w *pollWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *pollWatcher) Errors() <-chan error          { return w.errors }
+
+// Add takes the first snapshot of dir, files existing are not reported.
+func (w *pollWatcher) Add(dir string) error {
+	snap, err := scanDir(dir)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.dirs[dir]; !ok {
+		w.dirs[dir] = snap
+	}
+	return nil
+}
+
+func (w *pollWatcher) Remove(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.dirs[dir]; !ok {
+		return fmt.Errorf("can't remove non-existent poll watch for: %s", dir)
+	}
+	delete(w.dirs, dir)
+	return nil
+}
+
+func (w *pollWatcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *pollWatcher) loop() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !w.poll() {
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// poll scans every directory once, returns false if closed.
+func (w *pollWatcher) poll() bool {
+	w.mu.Lock()
+	dirs := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	w.mu.Unlock()
+
+	for _, dir := range dirs {
+		snap, err := scanDir(dir)
+		if os.IsNotExist(err) {
+			// removal is reported by the parent directory
+			continue
+		}
+		if err != nil {
+			select {
+			case w.errors <- err:
+				continue
+			case <-w.done:
+				return false
+			}
+		}
+
+		w.mu.Lock()
+		old, ok := w.dirs[dir]
+		if ok {
+			w.dirs[dir] = snap
+		}
+		w.mu.Unlock()
+		if !ok {
+			// removed during scanning
+			continue
+		}
+
+		for _, ev := range diffSnap(dir, old, snap) {
+			select {
+			case w.events <- ev:
+			case <-w.done:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func scanDir(dir string) (map[string]fileSnap, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := make(map[string]fileSnap, len(infos))
+	for _, info := range infos {
+		snap[info.Name()] = snapOf(info)
+	}
+	return snap, nil
+}
+
+// diffSnap returns the events from snapshot old to cur of dir.
+func diffSnap(dir string, old, cur map[string]fileSnap) []fsnotify.Event {
+	var events []fsnotify.Event
+	for name, o := range old {
+		c, ok := cur[name]
+		if !ok || c.ino != o.ino {
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+		}
+	}
+
+	for name, c := range cur {
+		file := filepath.Join(dir, name)
+		o, ok := old[name]
+		switch {
+		case !ok || c.ino != o.ino:
+			events = append(events, fsnotify.Event{Name: file, Op: fsnotify.Create})
+		case c.mode.IsDir():
+			// entries changed, reported by scanning the directory
+		case c.size != o.size || !c.mtime.Equal(o.mtime):
+			events = append(events, fsnotify.Event{Name: file, Op: fsnotify.Write})
+		case c.mode != o.mode:
+			events = append(events, fsnotify.Event{Name: file, Op: fsnotify.Chmod})
+		}
+	}
+	return events
+}
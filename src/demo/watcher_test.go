@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDiffSnap(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	file := fileSnap{size: 10, mtime: t0, mode: 0644, ino: 1}
+	dir := fileSnap{mtime: t0, mode: os.ModeDir | 0755, ino: 2}
+
+	with := func(f func(s *fileSnap)) fileSnap {
+		s := file
+		f(&s)
+		return s
+	}
+
+	for _, c := range []struct {
+		name string
+		old  map[string]fileSnap
+		cur  map[string]fileSnap
+		want []fsnotify.Event
+	}{
+		{"unchanged", map[string]fileSnap{"a": file}, map[string]fileSnap{"a": file}, nil},
+		{"create", nil, map[string]fileSnap{"a": file},
+			[]fsnotify.Event{{Name: "/s/a", Op: fsnotify.Create}}},
+		{"remove", map[string]fileSnap{"a": file}, nil,
+			[]fsnotify.Event{{Name: "/s/a", Op: fsnotify.Remove}}},
+		{"write size", map[string]fileSnap{"a": file}, map[string]fileSnap{"a": with(func(s *fileSnap) { s.size = 20 })},
+			[]fsnotify.Event{{Name: "/s/a", Op: fsnotify.Write}}},
+		{"write mtime", map[string]fileSnap{"a": file}, map[string]fileSnap{"a": with(func(s *fileSnap) { s.mtime = t0.Add(time.Second) })},
+			[]fsnotify.Event{{Name: "/s/a", Op: fsnotify.Write}}},
+		{"chmod", map[string]fileSnap{"a": file}, map[string]fileSnap{"a": with(func(s *fileSnap) { s.mode = 0600 })},
+			[]fsnotify.Event{{Name: "/s/a", Op: fsnotify.Chmod}}},
+		{"inode", map[string]fileSnap{"a": file}, map[string]fileSnap{"a": with(func(s *fileSnap) { s.ino = 3 })},
+			[]fsnotify.Event{{Name: "/s/a", Op: fsnotify.Remove}, {Name: "/s/a", Op: fsnotify.Create}}},
+		{"directory entries", map[string]fileSnap{"d": dir}, map[string]fileSnap{"d": {mtime: t0.Add(time.Second), mode: dir.mode, ino: 2}}, nil},
+	} {
+		got := diffSnap("/s", c.old, c.cur)
+		sort.SliceStable(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: events = %v, want %v", c.name, got, c.want)
+		}
+	}
+}